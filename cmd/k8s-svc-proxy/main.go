@@ -9,6 +9,8 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pedro-r-marques/k8s-service-proxy/pkg/proxy"
 )
@@ -16,11 +18,22 @@ import (
 type options struct {
 	Port          int
 	HTTPStaticDir string
+	Namespaces    string
+	RoutesFile    string
+	Kubernetes    proxy.KubernetesOptions
 }
 
 func defineFlags(opt *options) {
 	flag.IntVar(&opt.Port, "port", 8080, "Listening port")
 	flag.StringVar(&opt.HTTPStaticDir, "http-static-dir", "/var/www", "Directory for static http content")
+	flag.DurationVar(&opt.Kubernetes.ResyncPeriod, "resync-period", 10*time.Minute, "Interval at which the kubernetes service and endpoint caches are resynced")
+	flag.BoolVar(&opt.Kubernetes.UseEndpointSlices, "endpoint-slices", false, "Discover service backends from EndpointSlices rather than Endpoints")
+	flag.StringVar(&opt.Namespaces, "namespaces", "", "Comma separated list of namespaces to discover services from (default all)")
+	flag.StringVar(&opt.Kubernetes.LabelSelector, "selector", "", "Label selector that restricts the services exposed by the proxy")
+	flag.StringVar(&opt.Kubernetes.Kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, for running outside of the cluster")
+	flag.StringVar(&opt.Kubernetes.Context, "context", "", "The kubeconfig context to use")
+	flag.BoolVar(&opt.Kubernetes.WriteStatus, "write-status", false, "Write the k8s-svc-proxy.local/status annotation on the proxied services")
+	flag.StringVar(&opt.RoutesFile, "routes-file", "", "Load routes from a YAML file rather than from kubernetes services")
 }
 
 func defaultMuxServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -33,6 +46,9 @@ func main() {
 	var opt options
 	defineFlags(&opt)
 	flag.Parse()
+	if opt.Namespaces != "" {
+		opt.Kubernetes.Namespaces = strings.Split(opt.Namespaces, ",")
+	}
 
 	log.Print("Listening on port ", opt.Port)
 
@@ -53,6 +69,11 @@ func main() {
 
 	mux.HandleFunc(proxy.SvcProxyHTTPPath+"debug/", defaultMuxServeHTTP)
 
-	svcProxy := proxy.NewKubernetesServiceProxy(mux)
+	var svcProxy http.Handler
+	if opt.RoutesFile != "" {
+		svcProxy = proxy.NewServiceProxy(mux, proxy.NewFileRouteSource(opt.RoutesFile))
+	} else {
+		svcProxy = proxy.NewKubernetesServiceProxy(mux, &opt.Kubernetes)
+	}
 	http.ListenAndServe(fmt.Sprintf(":%d", opt.Port), svcProxy)
 }
@@ -1,3 +1,22 @@
+function formatConditions(kind, conditions) {
+    return $.map(conditions || [], function(c) {
+        return kind + " " + (c.Value ? c.Name + "=" + c.Value : c.Name);
+    });
+}
+
+function formatMatch(match) {
+    if (!match) {
+        return "";
+    }
+    var parts = [];
+    if (match.Methods) {
+        parts.push(match.Methods.join(","));
+    }
+    parts = parts.concat(formatConditions("header", match.Headers));
+    parts = parts.concat(formatConditions("query", match.Query));
+    return parts.join(" ");
+}
+
 function loadServiceTableContents(tableElement, response) {
     var tbody = tableElement.find('tbody');
     tbody.empty();
@@ -6,13 +25,28 @@ function loadServiceTableContents(tableElement, response) {
         var row = $('<tr>');
         tbody.append(row);
         row.append($('<td>').append(key));
+        row.append($('<td>').append(value.Host));
         var anchor = $('<a>');
-        anchor.attr("href", value.Path);
+        anchor.attr("href", value.Host ? "//" + value.Host + value.Path : value.Path);
         anchor.append(value.Path);
         row.append($('<td>').append(anchor));
-        row.append($('<td>').append(value.Port));
-        row.append($('<td>').append(value.Map));
+        row.append($('<td>').append(formatMatch(value.Match)));
+        var port = $('<td>').append(value.Port);
+        if (value.TargetPortName) {
+            port.append(" (" + value.TargetPortName + ")");
+        }
+        if (value.PortError) {
+            port.append($('<br>')).append($('<small>').text(value.PortError));
+        }
+        row.append(port);
+        row.append($('<td>').append(value.Rewrite ? value.Rewrite : value.Map));
         row.append($('<td>').append(value.Description));
+        row.append($('<td>').append(value.LoadBalancer));
+        row.append($('<td>').append(value.Health));
+        row.append($('<td>').append(value.Breaker));
+        row.append($('<td>').append(value.Traffic));
+        row.append($('<td>').append(value.Mirror));
+        row.append($('<td>').append(value.Conflicted ? "conflicted with " + value.ConflictsWith : ""));
     });
 }
 
@@ -38,16 +72,33 @@ function loadEndpointTableContents(tableElement, response) {
         $.each(status.Backends, function(podIndex, endpoint) {
             var row = $('<tr>');
             tbody.append(row);
-            var path = "/endpoint/" + status.Name + "/" + podIndex.toString();
-
-            var anchor = $('<a>');
-            anchor.attr("href", path);
-            anchor.append(path);
-            row.append($('<td>').append(anchor));
+            var path = "/endpoint/" + status.Name + "/" + podIndex.toString() + "/";
+            if (endpoint.PodName) {
+                path = "/pod/" + status.Name.split("/")[0] + "/" + endpoint.PodName + "/";
+            }
 
-            row.append($('<td>').append(status.Port));
+            var links = $('<td>');
+            var ports = $('<td>');
+            $.each(Object.keys(endpoint.Ports || {}).sort(), function(index, name) {
+                var port = endpoint.Ports[name];
+                var portPath = name ? path + name + "/" : path;
+                if (port) {
+                    var anchor = $('<a>');
+                    anchor.attr("href", portPath);
+                    anchor.append(portPath);
+                    links.append(anchor).append('<br>');
+                } else {
+                    links.append(portPath).append('<br>');
+                }
+                ports.append((name ? name + ": " : "") + (port ? port : "unresolved")).append('<br>');
+            });
+            row.append(links);
+            row.append(ports);
             row.append($('<td>').append(endpoint.PodName));
             row.append($('<td>').append(endpoint.IP));
+            row.append($('<td>').append(endpoint.Ready ? "yes" : "no"));
+            row.append($('<td>').append(endpoint.Health));
+            row.append($('<td>').append(endpoint.Breaker));
         });
     });
 }
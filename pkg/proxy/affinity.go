@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	affinityHeaderPrefix = "header:"
+	affinityCookiePrefix = "cookie:"
+	affinitySourceIP     = "source-ip"
+	affinityCookie       = "cookie"
+
+	// affinityCookieNamePrefix is the prefix of the cookies issued by the proxy.
+	affinityCookieNamePrefix = "k8s-svc-proxy."
+)
+
+type affinityKind int
+
+const (
+	affinityByHeader affinityKind = iota
+	affinityByCookie
+	affinityBySourceIP
+	// affinityByIssuedCookie uses a cookie set by the proxy that names the pod.
+	affinityByIssuedCookie
+)
+
+// affinityPolicy selects the pod of a service that receives the requests of a client.
+type affinityPolicy struct {
+	kind affinityKind
+	// name is the header or cookie that identifies the client.
+	name string
+}
+
+func newAffinityPolicy(svcID, value string) (*affinityPolicy, error) {
+	switch {
+	case value == affinitySourceIP:
+		return &affinityPolicy{kind: affinityBySourceIP}, nil
+	case value == affinityCookie:
+		name := affinityCookieNamePrefix + strings.Replace(svcID, "/", ".", 1)
+		return &affinityPolicy{kind: affinityByIssuedCookie, name: name}, nil
+	case strings.HasPrefix(value, affinityHeaderPrefix) && len(value) > len(affinityHeaderPrefix):
+		return &affinityPolicy{kind: affinityByHeader, name: value[len(affinityHeaderPrefix):]}, nil
+	case strings.HasPrefix(value, affinityCookiePrefix) && len(value) > len(affinityCookiePrefix):
+		return &affinityPolicy{kind: affinityByCookie, name: value[len(affinityCookiePrefix):]}, nil
+	}
+	return nil, fmt.Errorf("unknown affinity %q", value)
+}
+
+// key returns the value that identifies the client of a request, or the empty
+// string when the request does not carry one.
+func (a *affinityPolicy) key(r *http.Request) string {
+	switch a.kind {
+	case affinityByHeader:
+		return r.Header.Get(a.name)
+	case affinityByCookie, affinityByIssuedCookie:
+		if cookie, err := r.Cookie(a.name); err == nil {
+			return cookie.Value
+		}
+	case affinityBySourceIP:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+	return ""
+}
+
+// pick returns the pod pinned to the client of a request or nil when the request
+// is not pinned to any of the backends.
+func (a *affinityPolicy) pick(r *http.Request, backends []*podEndpoint) *podEndpoint {
+	key := a.key(r)
+	if key == "" {
+		return nil
+	}
+	if a.kind == affinityByIssuedCookie {
+		for _, e := range backends {
+			if e.PodName == key {
+				return e
+			}
+		}
+		return nil
+	}
+	return hashPick(key, backends)
+}
+
+// setCookie pins the client to a pod when the policy issues affinity cookies.
+func (a *affinityPolicy) setCookie(w http.ResponseWriter, r *http.Request, path string, backend *podEndpoint) {
+	if a.kind != affinityByIssuedCookie || a.key(r) == backend.PodName {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.name,
+		Value:    backend.PodName,
+		Path:     path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// hashPick selects a pod using rendezvous hashing: when a pod is removed only the
+// keys assigned to it move to other pods.
+func hashPick(key string, backends []*podEndpoint) *podEndpoint {
+	var best *podEndpoint
+	var bestScore uint64
+	for _, e := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.PodName))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAffinityPolicy(t *testing.T) {
+	testCases := []struct {
+		value string
+		kind  affinityKind
+		name  string
+	}{
+		{"header:X-User", affinityByHeader, "X-User"},
+		{"cookie:session", affinityByCookie, "session"},
+		{"source-ip", affinityBySourceIP, ""},
+		{"cookie", affinityByIssuedCookie, "k8s-svc-proxy.default.foo"},
+	}
+	for _, test := range testCases {
+		policy, err := newAffinityPolicy("default/foo", test.value)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if policy.kind != test.kind || policy.name != test.name {
+			t.Errorf("%s: %+v", test.value, policy)
+		}
+	}
+
+	for _, value := range []string{"", "header:", "ip", "cookie:"} {
+		if _, err := newAffinityPolicy("default/foo", value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+
+	policy, _ := newAffinityPolicy("default/foo", "source-ip")
+	req, _ := http.NewRequest("GET", "http://localhost/foo/", nil)
+	req.RemoteAddr = "10.0.0.1:4567"
+	if key := policy.key(req); key != "10.0.0.1" {
+		t.Error(key)
+	}
+}
+
+func TestHashPick(t *testing.T) {
+	var backends []*podEndpoint
+	for i := 0; i < 5; i++ {
+		backends = append(backends, &podEndpoint{PodName: fmt.Sprintf("pod-%d", i)})
+	}
+
+	assignment := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		assignment[key] = hashPick(key, backends).PodName
+	}
+
+	// Removing a pod only moves the keys that were assigned to it.
+	removed := backends[2].PodName
+	remaining := append(append([]*podEndpoint{}, backends[:2]...), backends[3:]...)
+	moved := 0
+	for key, prev := range assignment {
+		actual := hashPick(key, remaining).PodName
+		if prev != removed && actual != prev {
+			t.Errorf("%s moved from %s to %s", key, prev, actual)
+		}
+		if prev == removed {
+			moved++
+		}
+	}
+	if moved == 0 || moved == len(assignment) {
+		t.Errorf("unexpected key distribution: %d keys in %s", moved, removed)
+	}
+}
+
+func TestAffinityCookie(t *testing.T) {
+	hits := make(map[string]int)
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[name]++
+		})
+	}, "foo-a", "foo-b")
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:     "/foo/",
+				SvcProxyAnnotationAffinity: affinityCookie,
+			},
+		},
+	})
+	setEndpoints := func(names ...string) {
+		k8s.endpointUpdate(pods.endpoints(names))
+	}
+	setEndpoints("foo-a", "foo-b")
+
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		k8s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Error(rec.Code)
+		}
+		return rec
+	}
+
+	cookies := serve(nil).Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "k8s-svc-proxy.default.foo" || cookies[0].Path != "/foo/" {
+		t.Fatal(cookies)
+	}
+	pinned := cookies[0]
+	for i := 0; i < 4; i++ {
+		if rec := serve(pinned); len(rec.Result().Cookies()) != 0 {
+			t.Error("cookie reissued for a pinned client")
+		}
+	}
+	if hits[pinned.Value] != 5 {
+		t.Error(hits)
+	}
+
+	// The client is pinned to a new pod when its pod is removed.
+	other := "foo-a"
+	if pinned.Value == other {
+		other = "foo-b"
+	}
+	setEndpoints(other)
+	cookies = serve(pinned).Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != other {
+		t.Error(cookies)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	loadBalancerRoundRobin       = "round-robin"
+	loadBalancerLeastOutstanding = "least-outstanding"
+	loadBalancerRandomTwo        = "random-two"
+)
+
+// balancer selects the pod that receives a request.
+type balancer interface {
+	// pick is called with a non-empty list of ready pods.
+	pick(backends []*podEndpoint) *podEndpoint
+}
+
+type roundRobinBalancer struct {
+	next uint32
+}
+
+func (b *roundRobinBalancer) pick(backends []*podEndpoint) *podEndpoint {
+	n := atomic.AddUint32(&b.next, 1) - 1
+	return backends[n%uint32(len(backends))]
+}
+
+// leastOutstandingBalancer selects the pod with the fewest requests in progress.
+// The scan starts at a random offset so that ties are broken randomly.
+type leastOutstandingBalancer struct{}
+
+func (leastOutstandingBalancer) pick(backends []*podEndpoint) *podEndpoint {
+	offset := rand.Intn(len(backends))
+	var best *podEndpoint
+	for i := range backends {
+		e := backends[(offset+i)%len(backends)]
+		if best == nil || atomic.LoadInt32(&e.outstanding) < atomic.LoadInt32(&best.outstanding) {
+			best = e
+		}
+	}
+	return best
+}
+
+// randomTwoBalancer selects two pods at random and uses the one with fewer
+// requests in progress.
+type randomTwoBalancer struct{}
+
+func (randomTwoBalancer) pick(backends []*podEndpoint) *podEndpoint {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := backends[i], backends[j]
+	if atomic.LoadInt32(&b.outstanding) < atomic.LoadInt32(&a.outstanding) {
+		return b
+	}
+	return a
+}
+
+func newBalancer(policy string) (balancer, error) {
+	switch policy {
+	case loadBalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case loadBalancerLeastOutstanding:
+		return leastOutstandingBalancer{}, nil
+	case loadBalancerRandomTwo:
+		return randomTwoBalancer{}, nil
+	}
+	return nil, fmt.Errorf("unknown load balancer policy %q", policy)
+}
+
+// podBalancer proxies the requests of a service route directly to the pods
+// of the service, bypassing the service address.
+type podBalancer struct {
+	k        *k8sServiceProxy
+	svcID    string
+	endpoint *svcEndpoint
+	policy   balancer
+	affinity *affinityPolicy
+}
+
+// pickBackend selects a ready pod that is neither failing its health check nor ejected
+// by its circuit breaker. It returns the pod along with the handler that proxies
+// requests to it and its breaker, which are read under the lock since a change of the
+// route replaces them.
+func (b *podBalancer) pickBackend(r *http.Request) (*podEndpoint, http.Handler, *circuitBreaker) {
+	k := b.k
+	k.Lock()
+	defer k.Unlock()
+
+	data, exists := k.endpoints[b.svcID]
+	if !exists {
+		return nil, nil, nil
+	}
+	var ready []*podEndpoint
+	for _, e := range data.endpoints {
+		if !e.Ready || e.Health == healthStatusUnhealthy {
+			continue
+		}
+		if e.lbEndpoint == b.endpoint && e.Breaker != nil && !e.Breaker.available() {
+			continue
+		}
+		if b.endpoint.podPort(e) <= 0 {
+			continue
+		}
+		ready = append(ready, e)
+	}
+
+	for len(ready) > 0 {
+		var backend *podEndpoint
+		if b.affinity != nil {
+			backend = b.affinity.pick(r, ready)
+		}
+		if backend == nil {
+			backend = b.policy.pick(ready)
+		}
+		if backend.lbEndpoint != b.endpoint {
+			namespace := b.svcID[:strings.Index(b.svcID, "/")]
+			target := k.makeEndpointURL(namespace, backend, b.endpoint.podPort(backend))
+			if target == nil {
+				return nil, nil, nil
+			}
+			backend.lbHandler = k.newProxyHandler(target, b.endpoint)
+			backend.lbEndpoint = b.endpoint
+			backend.Breaker = nil
+			if config := b.endpoint.breakerConfig; config != nil && config.Failures > 0 {
+				backend.Breaker = newCircuitBreaker(config)
+			}
+		}
+		if backend.Breaker == nil || backend.Breaker.allow() {
+			return backend, backend.lbHandler, backend.Breaker
+		}
+		// The breaker of the pod opened, or another request took its probe, after the
+		// pod was found available; pick one of the remaining pods.
+		ready = removePod(ready, backend)
+	}
+	return nil, nil, nil
+}
+
+func removePod(list []*podEndpoint, pod *podEndpoint) []*podEndpoint {
+	result := make([]*podEndpoint, 0, len(list)-1)
+	for _, e := range list {
+		if e != pod {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (b *podBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend, handler, breaker := b.pickBackend(r)
+	if backend == nil {
+		http.Error(w, "No ready endpoints for service "+b.svcID, http.StatusServiceUnavailable)
+		return
+	}
+	if b.affinity != nil {
+		b.affinity.setCookie(w, r, b.endpoint.Path, backend)
+	}
+	atomic.AddInt32(&backend.outstanding, 1)
+	defer atomic.AddInt32(&backend.outstanding, -1)
+	if breaker != nil {
+		serveWithBreaker(b.svcID+" pod "+backend.PodName, breaker, handler, w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// podPort returns the port of a pod that serves a route balanced by the proxy, or 0 when
+// the named target port of the route is not a port of the pod.
+func (e *svcEndpoint) podPort(pod *podEndpoint) int {
+	if e.TargetPort > 0 {
+		return int(e.TargetPort)
+	}
+	return pod.portNames[e.endpointPortName]
+}
+
+// newServiceHandler returns the handler for a service route, applying the transport and
+// circuit breaker configuration of the route.
+func (k *k8sServiceProxy) newServiceHandler(svcID string, endpoint *svcEndpoint) http.Handler {
+	endpoint.transport = k.newTransport(svcID, endpoint.transportConfig)
+	handler := k.newRouteHandler(svcID, endpoint)
+	_, isBalanced := handler.(*podBalancer)
+	if endpoint.mirrorConfig != nil {
+		handler = k.newMirrorHandler(svcID, endpoint, handler)
+	}
+	if tc := endpoint.transportConfig; tc != nil && tc.RequestTimeout > 0 {
+		handler = &deadlineHandler{timeout: tc.RequestTimeout, next: handler}
+	}
+	config := endpoint.breakerConfig
+	if config == nil {
+		return handler
+	}
+	h := &breakerHandler{svcID: svcID, config: config, next: handler}
+	if !isBalanced && config.Failures > 0 {
+		h.breaker = newCircuitBreaker(config)
+		endpoint.Breaker = h.breaker
+	}
+	return h
+}
+
+// newRouteHandler returns the proxy handler of a service route. Services that select a load
+// balancer policy or a client affinity are balanced across their pods by the proxy;
+// otherwise requests are sent to the service address.
+func (k *k8sServiceProxy) newRouteHandler(svcID string, endpoint *svcEndpoint) http.Handler {
+	if endpoint.LoadBalancer == "" && endpoint.Affinity == "" {
+		return k.newProxyHandler(endpoint.target, endpoint)
+	}
+
+	lb := &podBalancer{k: k, svcID: svcID, endpoint: endpoint}
+	var err error
+	if endpoint.LoadBalancer != "" {
+		lb.policy, err = newBalancer(endpoint.LoadBalancer)
+	} else {
+		lb.policy = &roundRobinBalancer{}
+	}
+	if err != nil {
+		log.Printf("Invalid annotation %s for %s: %v", SvcProxyAnnotationLoadBalancer, svcID, err)
+		return k.newProxyHandler(endpoint.target, endpoint)
+	}
+	if endpoint.Affinity != "" {
+		if lb.affinity, err = newAffinityPolicy(svcID, endpoint.Affinity); err != nil {
+			log.Printf("Invalid annotation %s for %s: %v", SvcProxyAnnotationAffinity, svcID, err)
+			return k.newProxyHandler(endpoint.target, endpoint)
+		}
+	}
+	if endpoint.TargetPort <= 0 && endpoint.TargetPortName == "" {
+		log.Printf("Unable to determine the target port of %s; using the service address", svcID)
+		return k.newProxyHandler(endpoint.target, endpoint)
+	}
+	return lb
+}
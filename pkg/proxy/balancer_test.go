@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestBalancerPolicies(t *testing.T) {
+	backends := []*podEndpoint{
+		{PodName: "a", outstanding: 3},
+		{PodName: "b", outstanding: 1},
+		{PodName: "c", outstanding: 2},
+	}
+
+	rr := &roundRobinBalancer{}
+	var actual []string
+	for i := 0; i < 4; i++ {
+		actual = append(actual, rr.pick(backends).PodName)
+	}
+	if !reflect.DeepEqual(actual, []string{"a", "b", "c", "a"}) {
+		t.Error(actual)
+	}
+
+	for i := 0; i < 10; i++ {
+		if e := (leastOutstandingBalancer{}).pick(backends); e.PodName != "b" {
+			t.Errorf("least-outstanding: expected b, got %s", e.PodName)
+		}
+		if e := (randomTwoBalancer{}).pick(backends); e.PodName == "a" {
+			t.Error("random-two selected the most loaded backend")
+		}
+	}
+
+	if _, err := newBalancer("fastest"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestGetTargetPort(t *testing.T) {
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "tls", Port: 443, TargetPort: intstr.FromString("https")},
+				{Port: 9000},
+			},
+		},
+	}
+	testCases := []struct {
+		port     int32
+		expect   int32
+		name     string
+		portName string
+	}{
+		{80, 8080, "", ""},
+		{443, -1, "https", "tls"},
+		{9000, 9000, "", ""},
+		{6060, 6060, "", ""},
+		{-1, 8080, "", ""},
+	}
+	for _, test := range testCases {
+		actual, name, portName := getTargetPort(svc, test.port)
+		if actual != test.expect || name != test.name || portName != test.portName {
+			t.Errorf("%d: expected %d %q %q, got %d %q %q", test.port, test.expect, test.name, test.portName, actual, name, portName)
+		}
+	}
+}
+
+func TestPodBalancer(t *testing.T) {
+	hits := make(map[string]int)
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/bar/x" {
+				t.Error(r.URL.Path)
+			}
+			hits[name]++
+		})
+	}, "foo-a", "foo-b", "foo-c")
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:         "/foo/",
+				SvcProxyAnnotationMap:          "/bar/",
+				SvcProxyAnnotationLoadBalancer: loadBalancerRoundRobin,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}},
+		},
+	}
+	k8s.serviceAdd(svc)
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without endpoints, got %d", code)
+	}
+
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}, "foo-c"))
+
+	for i := 0; i < 4; i++ {
+		if code := serve(); code != http.StatusOK {
+			t.Error(code)
+		}
+	}
+	expected := map[string]int{"foo-a": 2, "foo-b": 2}
+	if !reflect.DeepEqual(hits, expected) {
+		t.Error(hits)
+	}
+	if port := pods.port("foo-a"); port != 8080 {
+		t.Errorf("Expected target port 8080, got %d", port)
+	}
+
+	// A resync of an unchanged service keeps the existing handler and balancer state.
+	handler := k8s.services["default/foo"].handler
+	k8s.serviceChange(svc)
+	if k8s.services["default/foo"].handler != handler {
+		t.Error("handler replaced for unchanged service")
+	}
+}
+
+func TestPodBalancerNamedTargetPort(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	}, "foo-a", "foo-b", "foo-c")
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:         "/foo/",
+				SvcProxyAnnotationPort:         "http",
+				SvcProxyAnnotationLoadBalancer: loadBalancerRoundRobin,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "metrics", Port: 9100},
+				{Name: "web", Port: 80, TargetPort: intstr.FromString("http")},
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+	if e := k8s.services["default/foo"]; e.Port != 80 || e.TargetPortName != "http" || e.PortError != "" {
+		t.Fatalf("%d %q %q", e.Port, e.TargetPortName, e.PortError)
+	}
+
+	// Pods of different versions of a deployment may use different ports.
+	k8s.endpointUpdate(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: pods.address("foo-a"), TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "foo-a"}}},
+				Ports:     []v1.EndpointPort{{Name: "web", Port: 8080}, {Name: "metrics", Port: 9100}},
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: pods.address("foo-b"), TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "foo-b"}}},
+				Ports:     []v1.EndpointPort{{Name: "web", Port: 9090}, {Name: "metrics", Port: 9100}},
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: pods.address("foo-c"), TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "foo-c"}}},
+				Ports:     []v1.EndpointPort{{Name: "metrics", Port: 9100}},
+			},
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Error(rec.Code)
+		}
+	}
+	for name, expected := range map[string]int{"foo-a": 8080, "foo-b": 9090, "foo-c": 0} {
+		if port := pods.port(name); port != expected {
+			t.Errorf("%s: expected port %d, got %d", name, expected, port)
+		}
+	}
+}
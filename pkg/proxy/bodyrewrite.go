@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	bodyRewriteHTML = "html"
+	bodyRewriteCSS  = "css"
+	bodyRewriteJS   = "js"
+
+	// bodyRewriteContext is the number of bytes that precede a link examined to decide
+	// whether it is a reference.
+	bodyRewriteContext = 64
+	bodyRewriteChunk   = 32 * 1024
+)
+
+// bodyRewriteTypes maps the media types of the responses that can be rewritten to the
+// kind of content they hold.
+var bodyRewriteTypes = map[string]string{
+	"text/html":              bodyRewriteHTML,
+	"application/xhtml+xml":  bodyRewriteHTML,
+	"text/css":               bodyRewriteCSS,
+	"text/javascript":        bodyRewriteJS,
+	"application/javascript": bodyRewriteJS,
+}
+
+func parseBodyRewrite(value string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(value, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch kind {
+		case "":
+		case bodyRewriteHTML, bodyRewriteCSS, bodyRewriteJS:
+			kinds = append(kinds, kind)
+		default:
+			return nil, fmt.Errorf("unknown content type %q", kind)
+		}
+	}
+	return kinds, nil
+}
+
+func makeBodyRewrite(svc *v1.Service) []string {
+	value, isSet := svc.Annotations[SvcProxyAnnotationRewriteBody]
+	if !isSet {
+		return nil
+	}
+	kinds, err := parseBodyRewrite(value)
+	if err != nil {
+		log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationRewriteBody, value, svc.Namespace, svc.Name, err)
+		return nil
+	}
+	return kinds
+}
+
+func trimQuote(b []byte) []byte {
+	if n := len(b); n > 0 && (b[n-1] == '"' || b[n-1] == '\'') {
+		return b[:n-1]
+	}
+	return b
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+func trimSpace(b []byte) []byte {
+	for len(b) > 0 && isSpace(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// cssReference reports whether the text that precedes a link is a url() function or an
+// @import rule.
+func cssReference(context []byte) bool {
+	context = trimSpace(trimQuote(context))
+	lower := bytes.ToLower(context)
+	return bytes.HasSuffix(lower, []byte("url(")) || bytes.HasSuffix(lower, []byte("@import"))
+}
+
+// htmlReference reports whether the text that precedes a link is a link attribute or a
+// url() reference in inline styles.
+func htmlReference(context []byte) bool {
+	if cssReference(context) {
+		return true
+	}
+	context = trimSpace(trimQuote(context))
+	if !bytes.HasSuffix(context, []byte("=")) {
+		return false
+	}
+	lower := bytes.ToLower(trimSpace(context[:len(context)-1]))
+	n := len(lower)
+	for n > 0 && !isSpace(lower[n-1]) {
+		n--
+	}
+	if n == 0 {
+		return false
+	}
+	switch string(lower[n:]) {
+	case "href", "src", "action", "formaction", "poster":
+		return true
+	}
+	return false
+}
+
+// jsReference reports whether a link starts a string literal.
+func jsReference(context []byte) bool {
+	n := len(context)
+	return n > 0 && (context[n-1] == '"' || context[n-1] == '\'' || context[n-1] == '`')
+}
+
+// linkRewriter is a reader that replaces the from prefix of the links of a document with
+// the to prefix. The input is processed as it streams; a link is rewritten when the text
+// that precedes it satisfies isReference.
+type linkRewriter struct {
+	src         io.Reader
+	from, to    []byte
+	isReference func([]byte) bool
+
+	// pending is input that has not been processed, out is output that has not been
+	// returned and context holds the last bytes of processed input.
+	pending []byte
+	out     []byte
+	context []byte
+	chunk   []byte
+	eof     bool
+}
+
+func (r *linkRewriter) remember(b []byte) {
+	r.context = append(r.context, b...)
+	if n := len(r.context); n > bodyRewriteContext {
+		r.context = append(r.context[:0], r.context[n-bodyRewriteContext:]...)
+	}
+}
+
+func (r *linkRewriter) emit(input, output []byte) {
+	r.out = append(r.out, output...)
+	r.remember(input)
+}
+
+// process rewrites the pending input. Unless the input is complete, the bytes that may be
+// the start of a link, along with the byte that follows it, are kept for the next call.
+func (r *linkRewriter) process() {
+	data := r.pending
+	pos := 0
+	for {
+		i := bytes.Index(data[pos:], r.from)
+		if i < 0 {
+			break
+		}
+		i += pos
+		end := i + len(r.from)
+		if end >= len(data) && !r.eof {
+			break
+		}
+		r.emit(data[pos:i], data[pos:i])
+		// Protocol relative URLs are not paths of the service.
+		protocolRelative := end < len(data) && data[end] == '/' && r.from[len(r.from)-1] == '/'
+		if !protocolRelative && r.isReference(r.context) {
+			r.emit(data[i:end], r.to)
+			pos = end
+		} else {
+			r.emit(data[i:i+1], data[i:i+1])
+			pos = i + 1
+		}
+	}
+	cut := len(data)
+	if !r.eof {
+		cut -= len(r.from)
+	}
+	if cut < pos {
+		cut = pos
+	}
+	r.emit(data[pos:cut], data[pos:cut])
+	r.pending = append([]byte(nil), data[cut:]...)
+}
+
+func (r *linkRewriter) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if r.chunk == nil {
+			r.chunk = make([]byte, bodyRewriteChunk)
+		}
+		n, err := r.src.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		r.process()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// rewrittenBody is the body of a rewritten response; closing it stops the rewrite.
+type rewrittenBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *rewrittenBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// rewriteResponseBody replaces the links of responses of a mapped route that point to the
+// Map prefix with links to the path of the route. Compressed responses are decoded and
+// encoded again; the rewritten response is sent without a Content-Length.
+func rewriteResponseBody(endpoint *svcEndpoint, resp *http.Response) error {
+	if len(endpoint.RewriteBody) == 0 || endpoint.Map == "" || endpoint.Map == endpoint.Path {
+		return nil
+	}
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	kind, exists := bodyRewriteTypes[mediaType]
+	if !exists || !containsValue(endpoint.RewriteBody, kind) {
+		return nil
+	}
+
+	var decoded io.Reader
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	switch encoding {
+	case "", "identity":
+		decoded = resp.Body
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to decode the response of %s: %v", resp.Request.URL, err)
+		}
+		decoded = gz
+	case "br":
+		decoded = brotli.NewReader(resp.Body)
+	default:
+		return nil
+	}
+
+	rewriter := &linkRewriter{src: decoded, from: []byte(endpoint.Map), to: []byte(endpoint.Path)}
+	switch kind {
+	case bodyRewriteHTML:
+		rewriter.isReference = htmlReference
+	case bodyRewriteCSS:
+		rewriter.isReference = cssReference
+	case bodyRewriteJS:
+		rewriter.isReference = jsReference
+	}
+
+	body := &rewrittenBody{Reader: rewriter, closers: []io.Closer{resp.Body}}
+	if decoded != resp.Body {
+		pr, pw := io.Pipe()
+		go func() {
+			var encoder io.WriteCloser
+			if encoding == "gzip" {
+				encoder = gzip.NewWriter(pw)
+			} else {
+				encoder = brotli.NewWriter(pw)
+			}
+			_, err := io.Copy(encoder, rewriter)
+			if cerr := encoder.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}()
+		body.Reader = pr
+		body.closers = append([]io.Closer{pr}, body.closers...)
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/andybalholm/brotli"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testHTML = `<html><head><link rel="stylesheet" HREF='/app/style.css'>
+<style>body { background: url(/app/bg.png) }</style></head>
+<body><a href="/app/page">page</a> <a href=/app/other>other</a> <img src = "/app/logo.png">
+<form action="/app/submit"><button formaction="/app/save">save</button></form> <p>See /app/page for details</p>
+<a href="//cdn.example.com/app/x">cdn</a> <a href="/application">no</a></body></html>`
+
+const testHTMLRewritten = `<html><head><link rel="stylesheet" HREF='/ui/style.css'>
+<style>body { background: url(/ui/bg.png) }</style></head>
+<body><a href="/ui/page">page</a> <a href=/ui/other>other</a> <img src = "/ui/logo.png">
+<form action="/ui/submit"><button formaction="/ui/save">save</button></form> <p>See /app/page for details</p>
+<a href="//cdn.example.com/app/x">cdn</a> <a href="/application">no</a></body></html>`
+
+func TestLinkRewriter(t *testing.T) {
+	for _, oneByte := range []bool{false, true} {
+		var src io.Reader = strings.NewReader(testHTML)
+		if oneByte {
+			src = iotest.OneByteReader(src)
+		}
+		r := &linkRewriter{src: src, from: []byte("/app/"), to: []byte("/ui/"), isReference: htmlReference}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != testHTMLRewritten {
+			t.Errorf("one byte reads %v: got\n%s", oneByte, out)
+		}
+	}
+
+	testCases := []struct {
+		isReference   func([]byte) bool
+		from          string
+		input, output string
+	}{
+		{cssReference, "/app/", `@import "/app/base.css"; a { b: url( '/app/x.png' ) }`, `@import "/ui/base.css"; a { b: url( '/ui/x.png' ) }`},
+		{jsReference, "/app/", "fetch('/app/api'); x = `/app/y`; z = a/app/b", "fetch('/ui/api'); x = `/ui/y`; z = a/app/b"},
+		// Protocol relative URLs are not rewritten when the prefix is the root.
+		{htmlReference, "/", `<a href="/x"><img src="//cdn/y">`, `<a href="/ui/x"><img src="//cdn/y">`},
+		// Attribute names are compared as a whole.
+		{htmlReference, "/app/", `<a data-href="/app/x" xsrc="/app/y">`, `<a data-href="/app/x" xsrc="/app/y">`},
+	}
+	for _, test := range testCases {
+		r := &linkRewriter{src: iotest.HalfReader(strings.NewReader(test.input)), from: []byte(test.from), to: []byte("/ui/"), isReference: test.isReference}
+		out, _ := ioutil.ReadAll(r)
+		if string(out) != test.output {
+			t.Errorf("expected %s, got %s", test.output, out)
+		}
+	}
+}
+
+func TestRewriteResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(testHTML)
+		var buf bytes.Buffer
+		switch r.URL.Query().Get("encoding") {
+		case "gzip":
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			body = buf.Bytes()
+		case "br":
+			br := brotli.NewWriter(&buf)
+			br.Write(body)
+			br.Close()
+			body = buf.Bytes()
+		}
+		if encoding := r.URL.Query().Get("encoding"); encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = func(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:        "/ui/",
+				SvcProxyAnnotationMap:         "/app/",
+				SvcProxyAnnotationRewriteBody: "html,css",
+			},
+		},
+	})
+
+	testCases := []struct {
+		encoding, contentType, expected string
+	}{
+		{"", "text/html; charset=utf-8", testHTMLRewritten},
+		{"gzip", "text/html", testHTMLRewritten},
+		{"br", "text/html", testHTMLRewritten},
+		{"", "application/javascript", testHTML},
+	}
+	for _, test := range testCases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://localhost/ui/?encoding="+test.encoding+"&type="+url.QueryEscape(test.contentType), nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		k8s.ServeHTTP(rec, req)
+		var body io.Reader = rec.Body
+		switch rec.Header().Get("Content-Encoding") {
+		case "gzip":
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		case "br":
+			body = brotli.NewReader(rec.Body)
+		}
+		out, err := ioutil.ReadAll(body)
+		if err != nil || string(out) != test.expected {
+			t.Errorf("%s %s: got %s (%v)", test.encoding, test.contentType, out, err)
+		}
+		if rec.Header().Get("Content-Encoding") != test.encoding {
+			t.Errorf("%s: got encoding %s", test.encoding, rec.Header().Get("Content-Encoding"))
+		}
+		if test.expected != testHTML && rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: unexpected Content-Length %s", test.encoding, rec.Header().Get("Content-Length"))
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultEjectionTime = 30 * time.Second
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breakerConfig is the circuit breaker configuration of a service route.
+type breakerConfig struct {
+	// Failures is the number of consecutive failed requests that opens the breaker;
+	// 0 disables it.
+	Failures     int
+	EjectionTime time.Duration
+	// MaxRequests limits the number of requests in progress; 0 means no limit.
+	MaxRequests int
+}
+
+func parseIntAnnotation(svc *v1.Service, annotation string) int {
+	s, exists := svc.Annotations[annotation]
+	if !exists {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		log.Printf("Invalid annotation %s (%s) for %s/%s", annotation, s, svc.Namespace, svc.Name)
+		return 0
+	}
+	return v
+}
+
+func makeBreakerConfig(svc *v1.Service) *breakerConfig {
+	config := &breakerConfig{
+		Failures:     parseIntAnnotation(svc, SvcProxyAnnotationBreakerFailures),
+		EjectionTime: parseDurationAnnotation(svc, SvcProxyAnnotationBreakerEjectionTime, defaultEjectionTime),
+		MaxRequests:  parseIntAnnotation(svc, SvcProxyAnnotationMaxRequests),
+	}
+	if config.Failures == 0 && config.MaxRequests == 0 {
+		return nil
+	}
+	return config
+}
+
+// circuitBreaker stops sending requests to a backend after a number of consecutive
+// failures. Once the ejection time expires a single request is let through; its
+// result either closes the breaker or opens it again.
+type circuitBreaker struct {
+	config *breakerConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(config *breakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config, now: time.Now, state: breakerClosed}
+}
+
+// available returns true when allow would admit a request.
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return !b.now().Before(b.openUntil)
+	case breakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// allow returns true when a request may be sent to the backend.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the result of a request and returns true
+// when the breaker opens. Successful requests that were admitted before the
+// breaker opened do not close it; only the probe of a half-open breaker does.
+func (b *circuitBreaker) record(failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.state == breakerOpen {
+			return false
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return false
+	}
+	b.failures++
+	if b.state == breakerOpen || b.state != breakerHalfOpen && b.failures < b.config.Failures {
+		return false
+	}
+	b.state = breakerOpen
+	b.openUntil = b.now().Add(b.config.EjectionTime)
+	b.probing = false
+	return true
+}
+
+// retryAfter returns the time until the breaker admits a request.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return b.openUntil.Sub(b.now())
+}
+
+// MarshalJSON reports the state of the breaker in the status pages.
+func (b *circuitBreaker) MarshalJSON() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return json.Marshal(b.state)
+}
+
+// statusRecorder records the status of a response written by the reverse proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", r.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// failed returns true for server errors, including the 502 responses generated by
+// the proxy when the backend is unreachable.
+func (r *statusRecorder) failed() bool {
+	return r.status >= 500
+}
+
+// serveWithBreaker forwards a request and records its result in the breaker.
+func serveWithBreaker(name string, breaker *circuitBreaker, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	if breaker.record(rec.failed()) {
+		log.Printf("Circuit breaker open for %s", name)
+	}
+}
+
+func serviceUnavailable(w http.ResponseWriter, svcID, reason string, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.5)))
+	}
+	http.Error(w, fmt.Sprintf("Service %s is unavailable: %s", svcID, reason), http.StatusServiceUnavailable)
+}
+
+// breakerHandler limits the requests in progress for a service route and, for
+// routes that use the service address, applies a circuit breaker to the service.
+// Routes balanced by the proxy eject failing pods individually.
+type breakerHandler struct {
+	svcID    string
+	config   *breakerConfig
+	breaker  *circuitBreaker
+	inflight int32
+	next     http.Handler
+}
+
+func (h *breakerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.config.MaxRequests > 0 {
+		defer atomic.AddInt32(&h.inflight, -1)
+		if atomic.AddInt32(&h.inflight, 1) > int32(h.config.MaxRequests) {
+			serviceUnavailable(w, h.svcID, "too many requests in progress", 0)
+			return
+		}
+	}
+	if h.breaker == nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if !h.breaker.allow() {
+		serviceUnavailable(w, h.svcID, "circuit breaker open", h.breaker.retryAfter())
+		return
+	}
+	serveWithBreaker(h.svcID, h.breaker, h.next, w, r)
+}
+
+// routeBalancer returns the pod balancer of a route handler, if any.
+func routeBalancer(handler http.Handler) *podBalancer {
+	for {
+		switch h := handler.(type) {
+		case *breakerHandler:
+			handler = h.next
+		case *deadlineHandler:
+			handler = h.next
+		case *mirrorHandler:
+			handler = h.next
+		case *podBalancer:
+			return h
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(&breakerConfig{Failures: 3, EjectionTime: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() || b.record(true) {
+			t.Fatalf("breaker open after %d failures", i+1)
+		}
+	}
+	b.record(false)
+	for i := 0; i < 2; i++ {
+		b.record(true)
+	}
+	if !b.allow() || !b.record(true) {
+		t.Fatal("breaker not open after 3 consecutive failures")
+	}
+	if b.allow() || b.available() {
+		t.Error("open breaker admits requests")
+	}
+	if d := b.retryAfter(); d != 10*time.Second {
+		t.Error(d)
+	}
+
+	// A request admitted before the breaker opened completes successfully.
+	b.record(false)
+	if b.state != breakerOpen || b.allow() {
+		t.Error("late success closes the open breaker")
+	}
+
+	// A single request is let through once the ejection time expires.
+	now = now.Add(10 * time.Second)
+	if !b.available() || !b.allow() {
+		t.Fatal("breaker does not admit a request after the ejection time")
+	}
+	if b.allow() {
+		t.Error("half-open breaker admits a second request")
+	}
+	if !b.record(true) {
+		t.Error("failed probe does not open the breaker")
+	}
+
+	now = now.Add(10 * time.Second)
+	b.allow()
+	b.record(false)
+	if b.state != breakerClosed || !b.allow() || !b.allow() {
+		t.Error(b.state)
+	}
+}
+
+func TestMakeBreakerConfig(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				SvcProxyAnnotationBreakerFailures: "5",
+				SvcProxyAnnotationMaxRequests:     "-1",
+			},
+		},
+	}
+	config := makeBreakerConfig(svc)
+	expected := &breakerConfig{Failures: 5, EjectionTime: defaultEjectionTime}
+	if config == nil || *config != *expected {
+		t.Error(config)
+	}
+
+	delete(svc.Annotations, SvcProxyAnnotationBreakerFailures)
+	if config := makeBreakerConfig(svc); config != nil {
+		t.Error(config)
+	}
+}
+
+func TestServiceBreaker(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	port := testServerPort(server)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:            "/foo/",
+				SvcProxyAnnotationPort:            port,
+				SvcProxyAnnotationBreakerFailures: "2",
+			},
+		},
+	})
+
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+	}
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "circuit breaker open") {
+		t.Error(rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Error(rec.Header())
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected 2 requests to the backend, got %d", n)
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost"+serviceDiscoveryPage, nil)
+	k8s.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"Breaker":"open"`) {
+		t.Error(rec.Body.String())
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer server.Close()
+	port := testServerPort(server)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:        "/foo/",
+				SvcProxyAnnotationPort:        port,
+				SvcProxyAnnotationMaxRequests: "1",
+			},
+		},
+	})
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+		done <- rec.Code
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo/y", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "too many requests") {
+		t.Error(rec.Code, rec.Body.String())
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Error(code)
+	}
+}
+
+func TestPodEjection(t *testing.T) {
+	hits := map[string]*int32{"foo-a": new(int32), "foo-b": new(int32)}
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(hits[name], 1)
+			if name == "foo-b" {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		})
+	}, "foo-a", "foo-b")
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:            "/foo/",
+				SvcProxyAnnotationLoadBalancer:    loadBalancerRoundRobin,
+				SvcProxyAnnotationBreakerFailures: "1",
+			},
+		},
+	})
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}))
+
+	for i := 0; i < 6; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+	}
+	if a, b := atomic.LoadInt32(hits["foo-a"]), atomic.LoadInt32(hits["foo-b"]); a != 5 || b != 1 {
+		t.Errorf("expected the failing pod to be ejected: %d, %d", a, b)
+	}
+	if state := k8s.endpoints["default/foo"].endpoints[1].Breaker.state; state != breakerOpen {
+		t.Error(state)
+	}
+}
+
+func TestPodBreakerOpensAfterPick(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}, "foo-a", "foo-b")
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:            "/foo/",
+				SvcProxyAnnotationLoadBalancer:    loadBalancerRoundRobin,
+				SvcProxyAnnotationBreakerFailures: "1",
+			},
+		},
+	})
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}))
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+	}
+
+	// The breaker of foo-a opens between the availability check and the pick.
+	breaker := k8s.endpoints["default/foo"].endpoints[0].Breaker
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	breaker.record(true)
+	calls := 0
+	breaker.now = func() time.Time {
+		calls++
+		if calls == 1 {
+			return now.Add(defaultEjectionTime)
+		}
+		return now
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "foo-b" {
+		t.Errorf("%d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPodBreakerRouteChange(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	}, "foo-a", "foo-b")
+	makeService := func(description string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "foo",
+				Annotations: map[string]string{
+					SvcProxyAnnotationPath:            "/foo/",
+					SvcProxyAnnotationLoadBalancer:    loadBalancerRoundRobin,
+					SvcProxyAnnotationBreakerFailures: "1",
+					SvcProxyAnnotationDescription:     description,
+				},
+			},
+		}
+	}
+	k8s.serviceAdd(makeService("previous"))
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}))
+	previous := k8s.services["default/foo"].handler
+	k8s.serviceChange(makeService("current"))
+	current := k8s.services["default/foo"].handler
+
+	// Requests in progress on the handler of the previous route replace the breakers of
+	// the pods while requests on the current route use them.
+	var wg sync.WaitGroup
+	for _, handler := range []http.Handler{previous, current, previous, current} {
+		wg.Add(1)
+		go func(handler http.Handler) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Error(rec.Code)
+				}
+			}
+		}(handler)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// rePortName matches the names of endpoint ports, which follow the syntax of the names
+// of kubernetes ports.
+var rePortName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// endpointPort is a port of the pods of a service exposed under /endpoint with a name.
+// When Port is 0, Target names a port of the endpoints of the service.
+type endpointPort struct {
+	Name   string
+	Port   int
+	Target string `json:",omitempty"`
+}
+
+func parsePortNumber(value string) (int, bool) {
+	v, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || v == 0 {
+		return 0, false
+	}
+	return int(v), true
+}
+
+// parseEndpointPorts parses a comma separated list of [name=]port entries. The entry
+// without a name is the default port of the pods; the port of a named entry is either a
+// number or the name of a port of the endpoints, e.g. "6060,admin=9000,metrics=http-metrics".
+func parseEndpointPorts(value string) (int, []*endpointPort, error) {
+	port := 0
+	var named []*endpointPort
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pieces := strings.SplitN(entry, "=", 2)
+		if len(pieces) == 1 {
+			v, ok := parsePortNumber(entry)
+			if !ok {
+				return 0, nil, fmt.Errorf("expected a port number or name=port, got %q", entry)
+			}
+			if port != 0 {
+				return 0, nil, fmt.Errorf("more than one port without a name")
+			}
+			port = v
+			continue
+		}
+		name, target := strings.TrimSpace(pieces[0]), strings.TrimSpace(pieces[1])
+		if !rePortName.MatchString(name) {
+			return 0, nil, fmt.Errorf("invalid port name %q", name)
+		}
+		if names[name] {
+			return 0, nil, fmt.Errorf("duplicate port name %q", name)
+		}
+		names[name] = true
+		p := &endpointPort{Name: name}
+		if _, err := strconv.Atoi(target); err == nil {
+			v, ok := parsePortNumber(target)
+			if !ok {
+				return 0, nil, fmt.Errorf("invalid port %q for %s", target, name)
+			}
+			p.Port = v
+		} else if rePortName.MatchString(target) {
+			p.Target = target
+		} else {
+			return 0, nil, fmt.Errorf("invalid port %q for %s", target, name)
+		}
+		named = append(named, p)
+	}
+	if port == 0 && len(named) == 0 {
+		return 0, nil, fmt.Errorf("expected a port number")
+	}
+	return port, named, nil
+}
+
+// getEndpointPorts returns the ports exposed under /endpoint for a service, or -1 when the
+// annotation is not set or invalid.
+func getEndpointPorts(svc *v1.Service) (int, []*endpointPort) {
+	value, exists := svc.Annotations[SvcProxyAnnotationEndpoint]
+	if !exists {
+		return -1, nil
+	}
+	port, named, err := parseEndpointPorts(value)
+	if err != nil {
+		return -1, nil
+	}
+	return port, named
+}
+
+// endpointPortNames maps the names of the ports of an Endpoints subset to their numbers.
+// The port of a service with a single unnamed port is listed with an empty name.
+func endpointPortNames(ports []v1.EndpointPort) map[string]int {
+	names := make(map[string]int, len(ports))
+	for _, p := range ports {
+		names[p.Name] = int(p.Port)
+	}
+	return names
+}
+
+// exposed reports whether the pods of the service are exposed under /endpoint.
+func (d *endpointData) exposed() bool {
+	return d.Port > 0 || len(d.NamedPorts) > 0
+}
+
+// resolvePorts computes the ports exposed by each pod of the service. Named ports that do
+// not match a port of the endpoints of a pod are listed with port 0. It must be called
+// with the lock held.
+func (d *endpointData) resolvePorts() {
+	for _, endpoint := range d.endpoints {
+		if !d.exposed() {
+			endpoint.Ports = nil
+			continue
+		}
+		ports := make(map[string]int, len(d.NamedPorts)+1)
+		if d.Port > 0 {
+			ports[""] = d.Port
+		}
+		for _, p := range d.NamedPorts {
+			if p.Port > 0 {
+				ports[p.Name] = p.Port
+			} else {
+				ports[p.Name] = endpoint.portNames[p.Target]
+			}
+		}
+		endpoint.Ports = ports
+	}
+}
+
+// selectPort picks the port of a pod named by the first segment of a request path, which
+// is removed from the path, or the default port. It returns 0 when there is no such port.
+func (e *podEndpoint) selectPort(path string) (int, string) {
+	pieces := strings.SplitN(path, "/", 2)
+	if port, exists := e.Ports[pieces[0]]; exists && pieces[0] != "" {
+		if len(pieces) < 2 {
+			return port, ""
+		}
+		return port, pieces[1]
+	}
+	return e.Ports[""], path
+}
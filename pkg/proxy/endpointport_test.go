@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseEndpointPorts(t *testing.T) {
+	testCases := []struct {
+		value    string
+		port     int
+		named    []*endpointPort
+		hasError bool
+	}{
+		{value: "6060", port: 6060},
+		{value: "debug=6060, admin=9000", named: []*endpointPort{{Name: "debug", Port: 6060}, {Name: "admin", Port: 9000}}},
+		{value: "6060,metrics=http-metrics", port: 6060, named: []*endpointPort{{Name: "metrics", Target: "http-metrics"}}},
+		{value: "pprof", hasError: true},
+		{value: "6060,7070", hasError: true},
+		{value: "debug=6060,debug=7070", hasError: true},
+		{value: "Debug=6060", hasError: true},
+		{value: "debug=", hasError: true},
+		{value: "debug=0", hasError: true},
+		{value: "", hasError: true},
+	}
+	for _, tc := range testCases {
+		port, named, err := parseEndpointPorts(tc.value)
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.value, err)
+			continue
+		}
+		if port != tc.port || !reflect.DeepEqual(named, tc.named) {
+			t.Errorf("%q: got %d %v", tc.value, port, named)
+		}
+	}
+}
+
+func TestSelectPort(t *testing.T) {
+	endpoint := &podEndpoint{Ports: map[string]int{"": 6060, "admin": 9000, "metrics": 0}}
+	testCases := []struct {
+		path string
+		port int
+		rest string
+	}{
+		{"debug/vars", 6060, "debug/vars"},
+		{"admin/status", 9000, "status"},
+		{"admin", 9000, ""},
+		{"metrics/", 0, ""},
+		{"", 6060, ""},
+	}
+	for _, tc := range testCases {
+		port, rest := endpoint.selectPort(tc.path)
+		if port != tc.port || port != 0 && rest != tc.rest {
+			t.Errorf("%q: got %d %q", tc.path, port, rest)
+		}
+	}
+}
+
+func TestEndpointNamedPorts(t *testing.T) {
+	var servers []*httptest.Server
+	var ports []int
+	for i := 0; i < 3; i++ {
+		id := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%d %s", id, r.URL.Path)
+		}))
+		defer server.Close()
+		p, _ := strconv.Atoi(testServerPort(server))
+		servers = append(servers, server)
+		ports = append(ports, p)
+	}
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationEndpoint: fmt.Sprintf("%d,admin=%d,metrics=http-metrics,missing=other", ports[0], ports[1]),
+			},
+		},
+	}
+	k8s.addEndpointPort(svc)
+	k8s.endpointUpdate(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "127.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "foo-xyz"}},
+				},
+				Ports: []v1.EndpointPort{{Name: "http-metrics", Port: int32(ports[2])}},
+			},
+		},
+	})
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/endpoint/default/foo/0/debug/vars", "0 /debug/vars"},
+		{"/endpoint/default/foo/foo-xyz/admin/status", "1 /status"},
+		{"/pod/default/foo-xyz/admin/", "1 /"},
+		{"/pod/default/foo-xyz/metrics/metrics", "2 /metrics"},
+		{"/pod/default/foo-xyz/missing/", ""},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost"+tc.path, nil)
+		k8s.ServeHTTP(w, req)
+		if tc.expected == "" {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: expected not found, got %d", tc.path, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK || w.Body.String() != tc.expected {
+			t.Errorf("%s: got %d %q", tc.path, w.Code, w.Body.String())
+		}
+	}
+
+	expected := map[string]int{"": ports[0], "admin": ports[1], "metrics": ports[2], "missing": 0}
+	if actual := k8s.endpoints["default/foo"].endpoints[0].Ports; !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+
+	k8s.deleteEndpointPort(svc)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/pod/default/foo-xyz/admin/", nil)
+	k8s.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Error(w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sort"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// makeEndpointSliceList converts the endpoints of a slice into podEndpoints.
+// Terminating endpoints are kept only while they are still serving requests.
+func makeEndpointSliceList(slice *discoveryv1.EndpointSlice) []*podEndpoint {
+	if slice.AddressType == discoveryv1.AddressTypeFQDN {
+		return nil
+	}
+	// ports maps the names of the ports of the slice to their numbers.
+	ports := make(map[string]int, len(slice.Ports))
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		var name string
+		if p.Name != nil {
+			name = *p.Name
+		}
+		ports[name] = int(*p.Port)
+	}
+	var endpoints []*podEndpoint
+	for _, e := range slice.Endpoints {
+		if len(e.Addresses) == 0 {
+			continue
+		}
+		ready := e.Conditions.Ready == nil || *e.Conditions.Ready
+		serving := ready
+		if e.Conditions.Serving != nil {
+			serving = *e.Conditions.Serving
+		}
+		terminating := e.Conditions.Terminating != nil && *e.Conditions.Terminating
+		if terminating && !serving {
+			continue
+		}
+
+		var podName string
+		if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+			podName = e.TargetRef.Name
+		}
+		endpoints = append(endpoints, &podEndpoint{
+			IP:        e.Addresses[0],
+			PodName:   podName,
+			Ready:     ready,
+			portNames: ports,
+		})
+	}
+	return endpoints
+}
+
+// mergeEndpointSlices combines the endpoints of all the slices of a service.
+// An address may transiently appear in more than one slice while it is moved
+// between slices; it is listed once, as ready if any slice reports it ready.
+func mergeEndpointSlices(slices map[string][]*podEndpoint) []*podEndpoint {
+	byIP := make(map[string]*podEndpoint)
+	var endpoints []*podEndpoint
+	for _, list := range slices {
+		for _, e := range list {
+			if prev, dup := byIP[e.IP]; dup {
+				prev.Ready = prev.Ready || e.Ready
+				continue
+			}
+			endpoint := *e
+			byIP[e.IP] = &endpoint
+			endpoints = append(endpoints, &endpoint)
+		}
+	}
+	sort.Sort(podEndpointSorter(endpoints))
+	return endpoints
+}
+
+func endpointSliceServiceID(slice *discoveryv1.EndpointSlice) (string, bool) {
+	svcName, exists := slice.Labels[discoveryv1.LabelServiceName]
+	if !exists {
+		return "", false
+	}
+	return slice.Namespace + "/" + svcName, true
+}
+
+func (k *k8sServiceProxy) endpointSliceUpdate(slice *discoveryv1.EndpointSlice) {
+	svcID, ok := endpointSliceServiceID(slice)
+	if !ok {
+		return
+	}
+
+	k.Lock()
+	slices, exists := k.endpointSlices[svcID]
+	if !exists {
+		slices = make(map[string][]*podEndpoint)
+		k.endpointSlices[svcID] = slices
+	}
+	slices[slice.Name] = makeEndpointSliceList(slice)
+	endpointList := mergeEndpointSlices(slices)
+	k.Unlock()
+
+	k.setEndpointList(svcID, endpointList)
+}
+
+func (k *k8sServiceProxy) endpointSliceDelete(slice *discoveryv1.EndpointSlice) {
+	svcID, ok := endpointSliceServiceID(slice)
+	if !ok {
+		return
+	}
+
+	k.Lock()
+	slices := k.endpointSlices[svcID]
+	delete(slices, slice.Name)
+	if len(slices) == 0 {
+		delete(k.endpointSlices, svcID)
+	}
+	endpointList := mergeEndpointSlices(slices)
+	k.Unlock()
+
+	k.setEndpointList(svcID, endpointList)
+}
+
+func (k *k8sServiceProxy) endpointSliceEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k.endpointSliceUpdate(obj.(*discoveryv1.EndpointSlice))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			k.endpointSliceUpdate(obj.(*discoveryv1.EndpointSlice))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if slice, ok := deletedObject(obj).(*discoveryv1.EndpointSlice); ok {
+				k.endpointSliceDelete(slice)
+			}
+		},
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func makeTestEndpointSlice(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "foo"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+	}
+}
+
+func makeTestSliceEndpoint(podName, ip string, conditions discoveryv1.EndpointConditions) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: conditions,
+		TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: podName},
+	}
+}
+
+func podEndpointSummary(endpoints []*podEndpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		s := e.PodName + "/" + e.IP
+		if !e.Ready {
+			s += " (not ready)"
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func TestEndpointSliceConditions(t *testing.T) {
+	slice := makeTestEndpointSlice("foo-abc",
+		makeTestSliceEndpoint("foo-a", "10.0.0.1", discoveryv1.EndpointConditions{}),
+		makeTestSliceEndpoint("foo-b", "10.0.0.2", discoveryv1.EndpointConditions{
+			Ready: boolPtr(false),
+		}),
+		makeTestSliceEndpoint("foo-c", "10.0.0.3", discoveryv1.EndpointConditions{
+			Ready: boolPtr(false), Serving: boolPtr(true), Terminating: boolPtr(true),
+		}),
+		makeTestSliceEndpoint("foo-d", "10.0.0.4", discoveryv1.EndpointConditions{
+			Ready: boolPtr(false), Serving: boolPtr(false), Terminating: boolPtr(true),
+		}),
+	)
+
+	actual := podEndpointSummary(makeEndpointSliceList(slice))
+	expected := []string{
+		"foo-a/10.0.0.1",
+		"foo-b/10.0.0.2 (not ready)",
+		"foo-c/10.0.0.3 (not ready)",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+}
+
+func TestEndpointSliceMerge(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	handler := k8s.endpointSliceEventHandler()
+
+	k8s.addEndpointPort(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Annotations: map[string]string{SvcProxyAnnotationEndpoint: "8080"},
+		},
+	})
+
+	sliceA := makeTestEndpointSlice("foo-abc",
+		makeTestSliceEndpoint("foo-b", "10.0.0.2", discoveryv1.EndpointConditions{}),
+		makeTestSliceEndpoint("foo-c", "10.0.0.3", discoveryv1.EndpointConditions{Ready: boolPtr(false)}),
+	)
+	sliceB := makeTestEndpointSlice("foo-xyz",
+		makeTestSliceEndpoint("foo-a", "10.0.0.1", discoveryv1.EndpointConditions{}),
+		makeTestSliceEndpoint("foo-c", "10.0.0.3", discoveryv1.EndpointConditions{}),
+	)
+	handler.OnAdd(sliceA)
+	handler.OnAdd(sliceB)
+
+	actual := podEndpointSummary(k8s.endpoints["default/foo"].endpoints)
+	expected := []string{"foo-a/10.0.0.1", "foo-b/10.0.0.2", "foo-c/10.0.0.3"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+
+	sliceB.Endpoints = sliceB.Endpoints[:1]
+	handler.OnUpdate(nil, sliceB)
+	actual = podEndpointSummary(k8s.endpoints["default/foo"].endpoints)
+	expected = []string{"foo-a/10.0.0.1", "foo-b/10.0.0.2", "foo-c/10.0.0.3 (not ready)"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+
+	handler.OnDelete(sliceA)
+	actual = podEndpointSummary(k8s.endpoints["default/foo"].endpoints)
+	expected = []string{"foo-a/10.0.0.1"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+
+	handler.OnDelete(sliceB)
+	if n := len(k8s.endpoints["default/foo"].endpoints); n != 0 {
+		t.Errorf("Expected no endpoints, got %d", n)
+	}
+	if len(k8s.endpointSlices) != 0 {
+		t.Error(k8s.endpointSlices)
+	}
+}
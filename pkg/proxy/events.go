@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "k8s-svc-proxy"
+
+	// eventReasonInvalidAnnotation is reported on a service with a proxy annotation
+	// that cannot be parsed.
+	eventReasonInvalidAnnotation = "InvalidAnnotation"
+
+	// eventReasonPathConflict is reported on a service whose route is claimed by
+	// another service that takes precedence.
+	eventReasonPathConflict = "PathConflict"
+)
+
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+func serviceReference(svc *v1.Service) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "Service",
+		APIVersion: "v1",
+		Namespace:  svc.Namespace,
+		Name:       svc.Name,
+		UID:        svc.UID,
+	}
+}
+
+// recordEvent reports an event on a service. Events are only recorded when the
+// routes are learnt from kubernetes.
+func (k *k8sServiceProxy) recordEvent(ref *v1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if k.recorder == nil || ref == nil {
+		return
+	}
+	k.recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+func validatePort(value string) error {
+	v, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || v == 0 {
+		return fmt.Errorf("expected a port number")
+	}
+	return nil
+}
+
+func validateServicePort(value string) error {
+	if validatePort(value) != nil && !rePortName.MatchString(value) {
+		return fmt.Errorf("expected a port number or name")
+	}
+	return nil
+}
+
+func validateEndpointPorts(value string) error {
+	_, _, err := parseEndpointPorts(value)
+	return err
+}
+
+func validateCount(value string) error {
+	if v, err := strconv.Atoi(value); err != nil || v < 0 {
+		return fmt.Errorf("expected a non-negative integer")
+	}
+	return nil
+}
+
+func validateDuration(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("expected a positive duration")
+	}
+	return nil
+}
+
+// annotationValidators check the syntax of the proxy annotations that have a value format.
+var annotationValidators = map[string]func(string) error{
+	SvcProxyAnnotationPort:     validateServicePort,
+	SvcProxyAnnotationEndpoint: validateEndpointPorts,
+	SvcProxyAnnotationPriority: func(value string) error {
+		_, err := strconv.ParseInt(value, 10, 32)
+		return err
+	},
+	SvcProxyAnnotationLoadBalancer: func(value string) error {
+		_, err := newBalancer(value)
+		return err
+	},
+	SvcProxyAnnotationAffinity: func(value string) error {
+		_, err := newAffinityPolicy("", value)
+		return err
+	},
+	SvcProxyAnnotationWeight: func(value string) error {
+		if _, err := strconv.ParseUint(value, 10, 31); err != nil {
+			return fmt.Errorf("expected a non-negative integer")
+		}
+		return nil
+	},
+	SvcProxyAnnotationRewrite: func(value string) error {
+		_, err := parseRewriteRules(value)
+		return err
+	},
+	SvcProxyAnnotationRewriteQuery: func(value string) error {
+		_, err := parseQueryEdits(value)
+		return err
+	},
+	SvcProxyAnnotationRewriteBody: func(value string) error {
+		_, err := parseBodyRewrite(value)
+		return err
+	},
+	SvcProxyAnnotationMirror: func(value string) error {
+		_, err := parseMirrorService(value, "default")
+		return err
+	},
+	SvcProxyAnnotationMirrorPercent: func(value string) error {
+		if v, err := strconv.Atoi(value); err != nil || v < 0 || v > 100 {
+			return fmt.Errorf("expected a percentage")
+		}
+		return nil
+	},
+	SvcProxyAnnotationMirrorMaxBody: validateCount,
+	SvcProxyAnnotationMatchMethods: func(value string) error {
+		_, err := parseMatchMethods(value)
+		return err
+	},
+	SvcProxyAnnotationMatchHeaders: func(value string) error {
+		_, err := parseMatchConditions(value, http.CanonicalHeaderKey)
+		return err
+	},
+	SvcProxyAnnotationMatchQuery: func(value string) error {
+		_, err := parseMatchConditions(value, identity)
+		return err
+	},
+	SvcProxyAnnotationHealthCheckInterval: validateDuration,
+	SvcProxyAnnotationHealthCheckTimeout:  validateDuration,
+	SvcProxyAnnotationHealthCheckStatus: func(value string) error {
+		if v, err := strconv.Atoi(value); err != nil || v < 100 || v > 599 {
+			return fmt.Errorf("expected an HTTP status code")
+		}
+		return nil
+	},
+	SvcProxyAnnotationBreakerFailures:       validateCount,
+	SvcProxyAnnotationBreakerEjectionTime:   validateDuration,
+	SvcProxyAnnotationMaxRequests:           validateCount,
+	SvcProxyAnnotationConnectTimeout:        validateDuration,
+	SvcProxyAnnotationResponseHeaderTimeout: validateDuration,
+	SvcProxyAnnotationRequestTimeout:        validateDuration,
+	SvcProxyAnnotationIdleConnTimeout:       validateDuration,
+	SvcProxyAnnotationMaxIdleConns:          validateCount,
+	SvcProxyAnnotationRetries:               validateCount,
+	SvcProxyAnnotationRetryBackoff:          validateDuration,
+}
+
+// expandedAnnotations are the proxy annotations that may refer to variables.
+var expandedAnnotations = map[string]bool{
+	SvcProxyAnnotationPath:        true,
+	SvcProxyAnnotationHost:        true,
+	SvcProxyAnnotationMap:         true,
+	SvcProxyAnnotationDescription: true,
+}
+
+// validateAnnotations returns a description of each invalid proxy annotation of a service.
+func validateAnnotations(svc *v1.Service) []string {
+	var keys []string
+	for key := range svc.Annotations {
+		if _, exists := annotationValidators[key]; exists || expandedAnnotations[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		value := svc.Annotations[key]
+		if expandedAnnotations[key] {
+			expanded, err := expandServiceVars(svc, value)
+			if err == nil && key == SvcProxyAnnotationPath {
+				if prefix := reservedPrefix(expanded, svc.Annotations[SvcProxyAnnotationHost] != ""); prefix != "" {
+					err = fmt.Errorf("%s is served by the proxy", prefix)
+				}
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid value %q: %v", key, value, err))
+			}
+			continue
+		}
+		if err := annotationValidators[key](value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid value %q: %v", key, value, err))
+		}
+	}
+	return problems
+}
+
+// checkAnnotations reports the invalid annotations of a service when they change.
+func (k *k8sServiceProxy) checkAnnotations(svc *v1.Service) {
+	svcID := svc.Namespace + "/" + svc.Name
+	problems := validateAnnotations(svc)
+	summary := strings.Join(problems, "; ")
+
+	k.Lock()
+	defer k.Unlock()
+	if k.invalidAnnotations[svcID] == summary {
+		return
+	}
+	if summary == "" {
+		delete(k.invalidAnnotations, svcID)
+		return
+	}
+	k.invalidAnnotations[svcID] = summary
+	for _, problem := range problems {
+		k.recordEvent(serviceReference(svc), v1.EventTypeWarning, eventReasonInvalidAnnotation, "%s", problem)
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestValidateAnnotations(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:                "/foo/",
+				SvcProxyAnnotationPort:                "8080/tcp",
+				SvcProxyAnnotationEndpoint:            "6060",
+				SvcProxyAnnotationRequestTimeout:      "10",
+				SvcProxyAnnotationHealthCheckInterval: "5s",
+				SvcProxyAnnotationLoadBalancer:        "fastest",
+			},
+		},
+	}
+	problems := validateAnnotations(svc)
+	if len(problems) != 3 {
+		t.Fatal(problems)
+	}
+	for i, key := range []string{SvcProxyAnnotationLoadBalancer, SvcProxyAnnotationPort, SvcProxyAnnotationRequestTimeout} {
+		if !strings.HasPrefix(problems[i], key+": invalid value") {
+			t.Errorf("expected %s, got %s", key, problems[i])
+		}
+	}
+}
+
+func TestCheckAnnotations(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	recorder := record.NewFakeRecorder(10)
+	k8s.recorder = recorder
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "example",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:     "/foo/",
+				SvcProxyAnnotationEndpoint: "pprof",
+			},
+		},
+	}
+	k8s.checkAnnotations(svc)
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning InvalidAnnotation "+SvcProxyAnnotationEndpoint) {
+			t.Error(event)
+		}
+	default:
+		t.Error("expected an event")
+	}
+
+	// Unchanged problems are not reported again on resync.
+	k8s.checkAnnotations(svc)
+	select {
+	case event := <-recorder.Events:
+		t.Error("unexpected event: ", event)
+	default:
+	}
+
+	svc.Annotations[SvcProxyAnnotationEndpoint] = "6060"
+	k8s.checkAnnotations(svc)
+	if _, exists := k8s.invalidAnnotations["default/example"]; exists {
+		t.Error(k8s.invalidAnnotations)
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fanoutPath = "/fanout/"
+
+	// fanoutMaxBody is the largest response body of a pod included in the result.
+	fanoutMaxBody = 1024 * 1024
+)
+
+var (
+	// fanoutConcurrency limits the number of pods queried at the same time by a request.
+	fanoutConcurrency = 16
+	// fanoutTimeout bounds the time spent on the request to each pod.
+	fanoutTimeout = 10 * time.Second
+)
+
+// hopHeaders are the headers that apply to a single connection, which are not forwarded
+// to the pods.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of a request, including the headers
+// named by its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// fanoutResult is the response of a pod to a fan-out request. Bodies that hold JSON are
+// included as such; other bodies are included as strings.
+type fanoutResult struct {
+	Status    int `json:",omitempty"`
+	Ready     bool
+	Latency   string          `json:",omitempty"`
+	Body      json.RawMessage `json:",omitempty"`
+	Truncated bool            `json:",omitempty"`
+	Error     string          `json:",omitempty"`
+}
+
+type fanoutTarget struct {
+	name   string
+	target *url.URL
+	result *fanoutResult
+}
+
+// fanoutTargets returns the URLs of a request path on each pod of a service, using the
+// ports exposed under /endpoint. It returns nil when the service does not expose its pods.
+func (k *k8sServiceProxy) fanoutTargets(key, path string) []*fanoutTarget {
+	k.Lock()
+	defer k.Unlock()
+
+	data, exists := k.endpoints[key]
+	if !exists || !data.exposed() {
+		return nil
+	}
+	namespace := key[:strings.Index(key, "/")]
+	targets := make([]*fanoutTarget, 0, len(data.endpoints))
+	for _, endpoint := range data.endpoints {
+		name := endpoint.PodName
+		if name == "" {
+			name = endpoint.IP
+		}
+		t := &fanoutTarget{name: name, result: &fanoutResult{Ready: endpoint.Ready}}
+		targets = append(targets, t)
+
+		port, podPath := endpoint.selectPort(path)
+		if port <= 0 {
+			t.result.Error = "no port"
+			continue
+		}
+		target := k.makeEndpointURL(namespace, endpoint, port)
+		if target == nil {
+			t.result.Error = "pod is not reachable"
+			continue
+		}
+		u := *target
+		u.Path = target.Path + "/" + podPath
+		t.target = &u
+	}
+	return targets
+}
+
+// fanoutBody converts a response body into JSON: bodies of JSON responses are kept as
+// they are and other bodies are encoded as a string.
+func fanoutBody(contentType string, body []byte, truncated bool) json.RawMessage {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && !truncated &&
+		(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && json.Valid(body) {
+		return body
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(string(body))
+	return encoded
+}
+
+func fanoutRequest(ctx context.Context, client *http.Client, r *http.Request, t *fanoutTarget) {
+	ctx, cancel := context.WithTimeout(ctx, fanoutTimeout)
+	defer cancel()
+
+	u := *t.target
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
+	if err != nil {
+		t.result.Error = err.Error()
+		return
+	}
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	// Let the transport decode compressed responses.
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set("X-Forwarded-Host", r.Host)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.result.Latency = time.Since(start).String()
+		t.result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, fanoutMaxBody+1))
+	t.result.Latency = time.Since(start).String()
+	t.result.Status = resp.StatusCode
+	if err != nil {
+		t.result.Error = err.Error()
+	}
+	if len(body) > fanoutMaxBody {
+		body = body[:fanoutMaxBody]
+		t.result.Truncated = true
+	}
+	t.result.Body = fanoutBody(resp.Header.Get("Content-Type"), body, t.result.Truncated)
+}
+
+// serveFanout sends a request to every pod of a service and responds with a JSON document
+// that holds the response of each pod, keyed by pod name.
+func (k *k8sServiceProxy) serveFanout(w http.ResponseWriter, r *http.Request) {
+	// /fanout/<namespace>/service/[port-name/]request-path
+	parts := strings.SplitN(r.URL.Path[1:], "/", 4)
+	if len(parts) < 4 {
+		http.Error(w, r.URL.Path, http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET and HEAD requests can be sent to all pods", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.Join(parts[1:3], "/")
+	targets := k.fanoutTargets(key, parts[3])
+	if targets == nil {
+		http.Error(w, fmt.Sprintf("Service %s does not expose its endpoints", key), http.StatusNotFound)
+		return
+	}
+
+	transport := k.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	pending := make(chan struct{}, fanoutConcurrency)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if t.target == nil {
+			continue
+		}
+		wg.Add(1)
+		pending <- struct{}{}
+		go func(t *fanoutTarget) {
+			defer func() {
+				<-pending
+				wg.Done()
+			}()
+			fanoutRequest(r.Context(), client, r, t)
+		}(t)
+	}
+	wg.Wait()
+
+	results := make(map[string]*fanoutResult, len(targets))
+	for _, t := range targets {
+		results[t.name] = t.result
+	}
+	js, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFanout(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		switch name {
+		case "foo-a":
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"path":%q,"query":%q}`, r.URL.Path, r.URL.RawQuery)
+			})
+		case "foo-b":
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusInternalServerError)
+			})
+		}
+		return nil
+	}, "foo-a", "foo-b", "foo-c")
+	k8s.addEndpointPort(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Annotations: map[string]string{SvcProxyAnnotationEndpoint: "6060"},
+		},
+	})
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}, "foo-c"))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/fanout/default/foo/debug/vars?x=1", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var results map[string]*fanoutResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal(rec.Body.String())
+	}
+	if r := results["foo-a"]; r.Status != http.StatusOK || !r.Ready || r.Latency == "" ||
+		string(r.Body) != `{"path":"/debug/vars","query":"x=1"}` {
+		t.Errorf("foo-a: %+v %s", r, r.Body)
+	}
+	var body string
+	if r := results["foo-b"]; r.Status != http.StatusInternalServerError || json.Unmarshal(r.Body, &body) != nil ||
+		body != "unavailable\n" {
+		t.Errorf("foo-b: %+v %s", r, r.Body)
+	}
+	if r := results["foo-c"]; r.Status != 0 || r.Ready || r.Error == "" {
+		t.Errorf("foo-c: %+v", r)
+	}
+
+	badRequests := map[string]int{
+		"http://localhost/fanout/default/bar/debug/vars": http.StatusNotFound,
+		"http://localhost/fanout/default/foo":            http.StatusNotFound,
+	}
+	for u, code := range badRequests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", u, nil)
+		k8s.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", u, code, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost/fanout/default/foo/debug/vars", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error(rec.Code)
+	}
+}
+
+func TestFanoutBody(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		body        string
+		truncated   bool
+		expected    string
+	}{
+		{"application/json", `{"a":1}`, false, `{"a":1}`},
+		{"application/problem+json; charset=utf-8", `{"a":1}`, false, `{"a":1}`},
+		{"application/json", `{"a":`, false, `"{\"a\":"`},
+		{"application/json", `{"a":1}`, true, `"{\"a\":1}"`},
+		{"text/plain", "ok", false, `"ok"`},
+		{"text/plain", "", false, ``},
+	}
+	for _, tc := range testCases {
+		actual := fanoutBody(tc.contentType, []byte(tc.body), tc.truncated)
+		if string(actual) != tc.expected {
+			t.Errorf("%s %q: expected %s, got %s", tc.contentType, tc.body, tc.expected, actual)
+		}
+	}
+}
+
+func TestFanoutLimits(t *testing.T) {
+	defer func(concurrency int, timeout time.Duration) {
+		fanoutConcurrency, fanoutTimeout = concurrency, timeout
+	}(fanoutConcurrency, fanoutTimeout)
+	fanoutConcurrency, fanoutTimeout = 2, 100*time.Millisecond
+
+	var inflight, maxInflight int32
+	var headers sync.Map
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inflight, 1)
+			defer atomic.AddInt32(&inflight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInflight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+					break
+				}
+			}
+			headers.Store(name, r.Header.Clone())
+			if name == "foo-slow" {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		})
+	}, "foo-a", "foo-b", "foo-c", "foo-slow")
+	k8s.addEndpointPort(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Annotations: map[string]string{SvcProxyAnnotationEndpoint: "6060"},
+		},
+	})
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b", "foo-c", "foo-slow"}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/fanout/default/foo/status", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-Trace", "abc")
+	k8s.ServeHTTP(rec, req)
+	var results map[string]*fanoutResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if r := results["foo-slow"]; r == nil || r.Status != 0 || !strings.Contains(r.Error, "deadline exceeded") {
+		t.Errorf("foo-slow: %+v", r)
+	}
+	for _, name := range []string{"foo-a", "foo-b", "foo-c"} {
+		if r := results[name]; r == nil || r.Status != http.StatusOK {
+			t.Errorf("%s: %+v", name, r)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInflight); max > 2 {
+		t.Errorf("%d requests in progress", max)
+	}
+
+	value, _ := headers.Load("foo-a")
+	h := value.(http.Header)
+	if h.Get("X-Hop") != "" || h.Get("Upgrade") != "" || h.Get("X-Trace") != "abc" {
+		t.Error(h)
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const routeFilePollInterval = 2 * time.Second
+
+// annotationValue accepts either a YAML string or number, since settings
+// such as ports are commonly written as numbers.
+type annotationValue string
+
+func (v *annotationValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = annotationValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("expected string or number, got %s", string(data))
+	}
+	*v = annotationValue(n.String())
+	return nil
+}
+
+type routeFileEndpoint struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// routeFileService describes a backend in the route file. Its settings are
+// equivalent to the annotations of a kubernetes service.
+type routeFileService struct {
+	Name         string              `json:"name"`
+	Namespace    string              `json:"namespace,omitempty"`
+	Host         string              `json:"host,omitempty"`
+	Path         string              `json:"path,omitempty"`
+	Port         annotationValue     `json:"port,omitempty"`
+	Map          string              `json:"map,omitempty"`
+	Description  string              `json:"description,omitempty"`
+	EndpointPort annotationValue     `json:"endpoint-port,omitempty"`
+	Endpoints    []routeFileEndpoint `json:"endpoints,omitempty"`
+	Annotations  map[string]string   `json:"annotations,omitempty"`
+}
+
+type routeFile struct {
+	Services []routeFileService `json:"services"`
+}
+
+// service builds the kubernetes Service equivalent to the route file entry.
+// Backends that specify a host are represented as ExternalName services.
+func (r *routeFileService) service() *v1.Service {
+	annotations := make(map[string]string)
+	for k, v := range r.Annotations {
+		annotations[k] = v
+	}
+	settings := map[string]string{
+		SvcProxyAnnotationPath:        r.Path,
+		SvcProxyAnnotationPort:        string(r.Port),
+		SvcProxyAnnotationMap:         r.Map,
+		SvcProxyAnnotationDescription: r.Description,
+		SvcProxyAnnotationEndpoint:    string(r.EndpointPort),
+	}
+	for k, v := range settings {
+		if v != "" {
+			annotations[k] = v
+		}
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   r.Namespace,
+			Name:        r.Name,
+			Annotations: annotations,
+		},
+	}
+	if r.Host != "" {
+		svc.Spec.Type = v1.ServiceTypeExternalName
+		svc.Spec.ExternalName = r.Host
+	}
+	return svc
+}
+
+func (r *routeFileService) endpoints() *v1.Endpoints {
+	var addresses []v1.EndpointAddress
+	for _, e := range r.Endpoints {
+		addresses = append(addresses, v1.EndpointAddress{
+			IP:        e.IP,
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: r.Namespace, Name: e.Name},
+		})
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: r.Namespace, Name: r.Name},
+	}
+	if len(addresses) > 0 {
+		endpoints.Subsets = []v1.EndpointSubset{{Addresses: addresses}}
+	}
+	return endpoints
+}
+
+// parseRouteFile returns the services and endpoints defined in a route file, keyed by
+// namespace/name.
+func parseRouteFile(contents []byte) (map[string]interface{}, map[string]interface{}, error) {
+	var config routeFile
+	if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+		return nil, nil, err
+	}
+
+	services := make(map[string]interface{})
+	endpoints := make(map[string]interface{})
+	for i := range config.Services {
+		entry := &config.Services[i]
+		if entry.Name == "" {
+			return nil, nil, fmt.Errorf("service %d: name is required", i)
+		}
+		if entry.Namespace == "" {
+			entry.Namespace = metav1.NamespaceDefault
+		}
+		svcID := entry.Namespace + "/" + entry.Name
+		if _, dup := services[svcID]; dup {
+			return nil, nil, fmt.Errorf("duplicate service %s", svcID)
+		}
+		services[svcID] = entry.service()
+		endpoints[svcID] = entry.endpoints()
+	}
+	return services, endpoints, nil
+}
+
+// syncObjects delivers the differences between two sets of objects to an event handler.
+func syncObjects(handler cache.ResourceEventHandler, prev, next map[string]interface{}) {
+	var keys []string
+	for key := range prev {
+		if _, exists := next[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		handler.OnDelete(prev[key])
+	}
+
+	keys = keys[:0]
+	for key := range next {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj := next[key]
+		if old, exists := prev[key]; !exists {
+			handler.OnAdd(obj)
+		} else if !reflect.DeepEqual(old, obj) {
+			handler.OnUpdate(old, obj)
+		}
+	}
+}
+
+// fileSource is a RouteSource that reads the service configuration from a YAML
+// file. The file is polled for changes, which also covers ConfigMap volumes
+// that are updated by replacing a symlink.
+type fileSource struct {
+	filename  string
+	interval  time.Duration
+	contents  []byte
+	lastErr   string
+	services  map[string]interface{}
+	endpoints map[string]interface{}
+}
+
+// NewFileRouteSource returns a RouteSource that loads routes from a YAML file and
+// reloads it when it changes. This allows the proxy to run without kubernetes.
+func NewFileRouteSource(filename string) RouteSource {
+	return &fileSource{filename: filename, interval: routeFilePollInterval}
+}
+
+func (s *fileSource) logError(err error) {
+	if msg := err.Error(); msg != s.lastErr {
+		log.Print(msg)
+		s.lastErr = msg
+	}
+}
+
+func (s *fileSource) reload(handlers *RouteHandlers) {
+	contents, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		s.logError(err)
+		return
+	}
+	if s.contents != nil && bytes.Equal(contents, s.contents) {
+		return
+	}
+	s.contents = contents
+
+	services, endpoints, err := parseRouteFile(contents)
+	if err != nil {
+		s.logError(fmt.Errorf("%s: %v", s.filename, err))
+		return
+	}
+	s.lastErr = ""
+	log.Print("Loading routes from ", s.filename)
+
+	syncObjects(handlers.Services, s.services, services)
+	syncObjects(handlers.Endpoints, s.endpoints, endpoints)
+	s.services = services
+	s.endpoints = endpoints
+}
+
+// Run loads the route file and then polls it for changes.
+func (s *fileSource) Run(handlers *RouteHandlers, stopCh <-chan struct{}) {
+	wait.Until(func() { s.reload(handlers) }, s.interval, stopCh)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseRouteFile(t *testing.T) {
+	contents := `
+services:
+  - name: grafana
+    namespace: monitoring
+    host: grafana.example.com
+    path: /grafana/
+    port: 3000
+    map: /
+    description: Dashboards
+    endpoint-port: 6060
+    endpoints:
+      - name: grafana-0
+        ip: 10.1.1.1
+  - name: debug
+    path: /debug/
+    annotations:
+      k8s-svc-proxy.local/port: "8080"
+`
+	services, endpoints, err := parseRouteFile([]byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := services["monitoring/grafana"].(*v1.Service)
+	expected := map[string]string{
+		SvcProxyAnnotationPath:        "/grafana/",
+		SvcProxyAnnotationPort:        "3000",
+		SvcProxyAnnotationMap:         "/",
+		SvcProxyAnnotationDescription: "Dashboards",
+		SvcProxyAnnotationEndpoint:    "6060",
+	}
+	if !reflect.DeepEqual(svc.Annotations, expected) {
+		t.Error(svc.Annotations)
+	}
+	if svc.Spec.Type != v1.ServiceTypeExternalName || svc.Spec.ExternalName != "grafana.example.com" {
+		t.Error(svc.Spec)
+	}
+	if u := makeServiceURL(svc, makeSvcEndpoint(svc)); u.String() != "http://grafana.example.com:3000" {
+		t.Error(u)
+	}
+
+	podEndpoints := makeEndpointList(endpoints["monitoring/grafana"].(*v1.Endpoints))
+	if len(podEndpoints) != 1 || podEndpoints[0].PodName != "grafana-0" || podEndpoints[0].IP != "10.1.1.1" {
+		t.Error(podEndpoints)
+	}
+
+	svc = services["default/debug"].(*v1.Service)
+	if svc.Annotations[SvcProxyAnnotationPort] != "8080" || svc.Spec.Type != "" {
+		t.Error(svc)
+	}
+
+	badFiles := []string{
+		"services:\n  - path: /foo/\n",
+		"services:\n  - name: foo\n  - name: foo\n",
+		"services:\n  - name: foo\n    unknown: x\n",
+	}
+	for _, contents := range badFiles {
+		if _, _, err := parseRouteFile([]byte(contents)); err == nil {
+			t.Errorf("Expected error for %q", contents)
+		}
+	}
+}
+
+func TestFileSourceReload(t *testing.T) {
+	var pathlist []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathlist = append(pathlist, r.URL.Path)
+	}))
+	defer server.Close()
+	backendAddrPieces := strings.Split(server.Listener.Addr().String(), ":")
+
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "routes.yaml")
+
+	writeRoutes := func(format string) {
+		contents := fmt.Sprintf(format, backendAddrPieces[1])
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRoutes(`
+services:
+  - name: foo
+    host: 127.0.0.1
+    port: %[1]s
+    path: /foo/
+    map: /bar/
+  - name: baz
+    host: 127.0.0.1
+    path: /baz/
+    port: %[1]s
+`)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	source := &fileSource{filename: filename, interval: 10 * time.Millisecond}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go k8s.run(source, stopCh)
+
+	servicePaths := func() []string {
+		var paths []string
+		for _, endpoint := range k8s.services {
+			paths = append(paths, endpoint.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	waitForCondition(t, k8s, func() bool {
+		return reflect.DeepEqual(servicePaths(), []string{"/baz/", "/foo/"})
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error(rec.Code)
+	}
+	if !reflect.DeepEqual(pathlist, []string{"/bar/x"}) {
+		t.Error(pathlist)
+	}
+
+	writeRoutes(`
+services:
+  - name: foo
+    host: 127.0.0.1
+    port: %[1]s
+    path: /foo2/
+`)
+	waitForCondition(t, k8s, func() bool {
+		return reflect.DeepEqual(servicePaths(), []string{"/foo2/"})
+	})
+
+	// An invalid file leaves the current configuration in place.
+	writeRoutes("services: [")
+	time.Sleep(50 * time.Millisecond)
+	k8s.Lock()
+	paths := servicePaths()
+	k8s.Unlock()
+	if !reflect.DeepEqual(paths, []string{"/foo2/"}) {
+		t.Error(paths)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// linkTarget matches the URI references of a Link header.
+var linkTarget = regexp.MustCompile(`<[^>]*>`)
+
+// remapURL translates a URL of a response header into the path space of the proxy. URLs
+// on other hosts and URLs outside of the mapping of the route are returned unchanged.
+func remapURL(endpoint *svcEndpoint, basePath string, resp *http.Response, value string) string {
+	if otherHost(resp.Request.URL, value) {
+		return value
+	}
+	if mapped := invRemap(endpoint, basePath, resp.Request.URL, []string{value}); len(mapped) > 0 {
+		return mapped[0]
+	}
+	return value
+}
+
+// remapRefresh translates the URL of a Refresh header, of the form "5; url=/path".
+func remapRefresh(endpoint *svcEndpoint, basePath string, resp *http.Response, value string) string {
+	pieces := strings.SplitN(value, ";", 2)
+	if len(pieces) != 2 {
+		return value
+	}
+	param := strings.TrimSpace(pieces[1])
+	if len(param) < 4 || !strings.EqualFold(param[:4], "url=") {
+		return value
+	}
+	target := strings.Trim(param[4:], `"' `)
+	return pieces[0] + "; url=" + remapURL(endpoint, basePath, resp, target)
+}
+
+// remapLink translates the URI references of a Link header.
+func remapLink(endpoint *svcEndpoint, basePath string, resp *http.Response, value string) string {
+	return linkTarget.ReplaceAllStringFunc(value, func(ref string) string {
+		return "<" + remapURL(endpoint, basePath, resp, ref[1:len(ref)-1]) + ">"
+	})
+}
+
+// remapCookie translates the Path attribute of a Set-Cookie header with mapPath and, for
+// routes that are selected by host, replaces a Domain attribute that does not cover the
+// public host of the request.
+func remapCookie(endpoint *svcEndpoint, resp *http.Response, value string, mapPath func(string) string) string {
+	attrs := strings.Split(value, ";")
+	for i, attr := range attrs[1:] {
+		pieces := strings.SplitN(strings.TrimSpace(attr), "=", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+		name, v := pieces[0], pieces[1]
+		switch {
+		case mapPath != nil && strings.EqualFold(name, "Path"):
+			attrs[i+1] = " " + name + "=" + mapPath(v)
+		case endpoint.Host != "" && strings.EqualFold(name, "Domain"):
+			host := requestHost(resp.Request)
+			domain := strings.ToLower(strings.TrimPrefix(v, "."))
+			if host != domain && !strings.HasSuffix(host, "."+domain) {
+				attrs[i+1] = " " + name + "=" + host
+			}
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+func remapCookies(endpoint *svcEndpoint, resp *http.Response, mapPath func(string) string) {
+	cookies := resp.Header["Set-Cookie"]
+	for i, v := range cookies {
+		cookies[i] = remapCookie(endpoint, resp, v, mapPath)
+	}
+}
+
+// remapResponseHeaders translates the URLs of the Content-Location, Refresh, Link and
+// Set-Cookie headers of a response into the path space of the proxy. The Location header
+// is handled by the caller, since a redirect that cannot be translated is an error.
+func remapResponseHeaders(endpoint *svcEndpoint, basePath string, resp *http.Response) {
+	for i, v := range resp.Header.Values("Content-Location") {
+		resp.Header["Content-Location"][i] = remapURL(endpoint, basePath, resp, v)
+	}
+	for i, v := range resp.Header.Values("Refresh") {
+		resp.Header["Refresh"][i] = remapRefresh(endpoint, basePath, resp, v)
+	}
+	for i, v := range resp.Header.Values("Link") {
+		resp.Header["Link"][i] = remapLink(endpoint, basePath, resp, v)
+	}
+	remapCookies(endpoint, resp, func(cookiePath string) string {
+		mapped := remapURL(endpoint, basePath, resp, cookiePath)
+		if strings.HasSuffix(cookiePath, "/") && !strings.HasSuffix(mapped, "/") {
+			mapped += "/"
+		}
+		return mapped
+	})
+}
+
+// trimCookiePath returns a function that removes the path prefix of the target URL from
+// cookie paths, or nil when the target URL has no path.
+func trimCookiePath(prefix string) func(string) string {
+	if prefix == "" {
+		return nil
+	}
+	return func(cookiePath string) string {
+		p := strings.TrimPrefix(cookiePath, prefix)
+		if p == cookiePath {
+			return cookiePath
+		}
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+}
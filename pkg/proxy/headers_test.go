@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRemapResponseHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bar/login" {
+			http.Redirect(w, r, "https://accounts.example.com/bar/login?next=1", http.StatusFound)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Location", "/bar/items/1?v=2")
+		h.Set("Refresh", "5; URL=/bar/done")
+		h.Set("Link", `</bar/style.css>; rel=preload; as=style, <https://cdn.example.com/bar/x.js>; rel=preload`)
+		h.Add("Set-Cookie", "session=abc; Path=/bar/; HttpOnly")
+		h.Add("Set-Cookie", "theme=dark; path=/bar/settings; Domain=backend.default.svc")
+		h.Add("Set-Cookie", "global=1; Path=/")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = func(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+	makeService := func(name string, annotations map[string]string) {
+		k8s.serviceAdd(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		})
+	}
+	makeService("mapped", map[string]string{SvcProxyAnnotationPath: "/foo/", SvcProxyAnnotationMap: "/bar/"})
+	makeService("host", map[string]string{SvcProxyAnnotationHost: "app.example.com"})
+	makeService("rewritten", map[string]string{SvcProxyAnnotationPath: "/baz/", SvcProxyAnnotationRewrite: `^/baz/(.*) /bar/$1`})
+
+	rec := httptest.NewRecorder()
+	k8s.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/foo/items", nil))
+	h := rec.Header()
+	expected := map[string][]string{
+		"Content-Location": {"/foo/items/1?v=2"},
+		"Refresh":          {"5; url=/foo/done"},
+		"Link":             {`</foo/style.css>; rel=preload; as=style, <https://cdn.example.com/bar/x.js>; rel=preload`},
+		"Set-Cookie": {
+			"session=abc; Path=/foo/; HttpOnly",
+			"theme=dark; path=/foo/settings; Domain=backend.default.svc",
+			"global=1; Path=/",
+		},
+	}
+	for name, values := range expected {
+		if !reflect.DeepEqual(h[name], values) {
+			t.Errorf("%s: expected %q, got %q", name, values, h[name])
+		}
+	}
+
+	// Redirects to other hosts are left unchanged, although their path is in the mapping.
+	for _, path := range []string{"/foo/login", "/baz/login"} {
+		rec = httptest.NewRecorder()
+		k8s.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost"+path, nil))
+		if location := rec.Header().Get("Location"); rec.Code != http.StatusFound ||
+			location != "https://accounts.example.com/bar/login?next=1" {
+			t.Errorf("%s: %d %s", path, rec.Code, location)
+		}
+	}
+
+	// Routes selected by host replace cookie domains that do not match the public host.
+	rec = httptest.NewRecorder()
+	k8s.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.example.com/bar/items", nil))
+	cookies := rec.Header()["Set-Cookie"]
+	if len(cookies) != 3 || cookies[1] != "theme=dark; path=/bar/settings; Domain=app.example.com" {
+		t.Errorf("%q", cookies)
+	}
+}
+
+func TestRemapCookieDomain(t *testing.T) {
+	endpoint := &svcEndpoint{Host: "*.example.com"}
+	resp := &http.Response{Request: &http.Request{Host: "grafana.example.com:8080"}}
+	testCases := map[string]string{
+		"a=1; Domain=example.com":          "a=1; Domain=example.com",
+		"a=1; Domain=.grafana.example.com": "a=1; Domain=.grafana.example.com",
+		"a=1; Domain=grafana.svc":          "a=1; Domain=grafana.example.com",
+		"a=1":                              "a=1",
+	}
+	for value, expected := range testCases {
+		if actual := remapCookie(endpoint, resp, value, nil); actual != expected {
+			t.Errorf("%s: expected %s, got %s", value, expected, actual)
+		}
+	}
+}
+
+func TestTrimCookiePath(t *testing.T) {
+	if trimCookiePath("") != nil {
+		t.Error("expected no path mapping")
+	}
+	trim := trimCookiePath("/api/v1/namespaces/default/services/foo/proxy")
+	testCases := map[string]string{
+		"/api/v1/namespaces/default/services/foo/proxy/bar/": "/bar/",
+		"/api/v1/namespaces/default/services/foo/proxy":      "/",
+		"/other/": "/other/",
+	}
+	for value, expected := range testCases {
+		if actual := trim(value); actual != expected {
+			t.Errorf("%s: expected %s, got %s", value, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+
+	healthStatusHealthy   = "healthy"
+	healthStatusUnhealthy = "unhealthy"
+)
+
+// healthCheck is the configuration of the active health check of a service route.
+type healthCheck struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Status is the expected response status; 0 accepts any 2xx status.
+	Status int
+}
+
+func parseDurationAnnotation(svc *v1.Service, annotation string, value time.Duration) time.Duration {
+	s, exists := svc.Annotations[annotation]
+	if !exists {
+		return value
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid annotation %s (%s) for %s/%s", annotation, s, svc.Namespace, svc.Name)
+		return value
+	}
+	return d
+}
+
+func makeHealthCheck(svc *v1.Service) *healthCheck {
+	path, exists := svc.Annotations[SvcProxyAnnotationHealthCheckPath]
+	if !exists {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	hc := &healthCheck{
+		Path:     path,
+		Interval: parseDurationAnnotation(svc, SvcProxyAnnotationHealthCheckInterval, defaultHealthCheckInterval),
+		Timeout:  parseDurationAnnotation(svc, SvcProxyAnnotationHealthCheckTimeout, defaultHealthCheckTimeout),
+	}
+	if s, exists := svc.Annotations[SvcProxyAnnotationHealthCheckStatus]; exists {
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 100 || status > 599 {
+			log.Printf("Invalid annotation %s (%s) for %s/%s", SvcProxyAnnotationHealthCheckStatus, s, svc.Namespace, svc.Name)
+		} else {
+			hc.Status = status
+		}
+	}
+	return hc
+}
+
+func (hc *healthCheck) check(client *http.Client, target *url.URL) error {
+	u := *target
+	u.Path = target.Path + hc.Path
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if hc.Status != 0 && resp.StatusCode != hc.Status ||
+		hc.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthTarget is a backend probed by a health check; pod is nil when the
+// check targets the service address.
+type healthTarget struct {
+	pod    *podEndpoint
+	target *url.URL
+	err    error
+}
+
+// healthCheckTargets returns the backends of a service route: its pods when the
+// route is balanced by the proxy, otherwise the service address.
+func (k *k8sServiceProxy) healthCheckTargets(svcID string, endpoint *svcEndpoint) []*healthTarget {
+	k.Lock()
+	defer k.Unlock()
+	if k.services[svcID] != endpoint {
+		return nil
+	}
+	if routeBalancer(endpoint.handler) == nil {
+		if endpoint.target == nil {
+			return nil
+		}
+		return []*healthTarget{{target: endpoint.target}}
+	}
+
+	data, exists := k.endpoints[svcID]
+	if !exists {
+		return nil
+	}
+	namespace := svcID[:strings.Index(svcID, "/")]
+	var targets []*healthTarget
+	for _, e := range data.endpoints {
+		port := endpoint.podPort(e)
+		if port <= 0 {
+			continue
+		}
+		if target := k.makeEndpointURL(namespace, e, port); target != nil {
+			targets = append(targets, &healthTarget{pod: e, target: target})
+		}
+	}
+	return targets
+}
+
+func healthStatus(err error) string {
+	if err != nil {
+		return healthStatusUnhealthy
+	}
+	return healthStatusHealthy
+}
+
+func (k *k8sServiceProxy) runHealthCheck(svcID string, endpoint *svcEndpoint, client *http.Client) {
+	targets := k.healthCheckTargets(svcID, endpoint)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *healthTarget) {
+			defer wg.Done()
+			t.err = endpoint.healthCheck.check(client, t.target)
+		}(t)
+	}
+	wg.Wait()
+
+	k.Lock()
+	defer k.Unlock()
+	// The results of a check that was stopped while it ran are discarded.
+	if k.services[svcID] != endpoint || endpoint.healthStop == nil {
+		return
+	}
+	healthy := 0
+	probed := make(map[*podEndpoint]bool)
+	for _, t := range targets {
+		status := healthStatus(t.err)
+		name := svcID
+		prev := &endpoint.Health
+		if t.pod != nil {
+			name = svcID + " pod " + t.pod.PodName
+			prev = &t.pod.Health
+			probed[t.pod] = true
+		}
+		if *prev != status && t.err != nil {
+			log.Printf("Health check failed for %s: %v", name, t.err)
+		}
+		*prev = status
+		if t.err == nil {
+			healthy++
+		}
+	}
+	// Pods that are no longer probed, e.g. after the port of the route changed, are not
+	// excluded by a previous result.
+	k.resetPodHealth(svcID, probed)
+	if len(targets) > 0 && targets[0].pod != nil {
+		if healthy > 0 {
+			endpoint.Health = healthStatusHealthy
+		} else {
+			endpoint.Health = healthStatusUnhealthy
+		}
+	}
+}
+
+// startHealthCheck probes the backends of a service route until the route is removed.
+func (k *k8sServiceProxy) startHealthCheck(svcID string, endpoint *svcEndpoint) {
+	if endpoint.healthCheck == nil {
+		return
+	}
+	client := &http.Client{
+		Transport: endpoint.transport,
+		Timeout:   endpoint.healthCheck.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	endpoint.healthStop = make(chan struct{})
+	go wait.Until(func() {
+		k.runHealthCheck(svcID, endpoint, client)
+	}, endpoint.healthCheck.Interval, endpoint.healthStop)
+}
+
+// stopHealthCheck stops the health check of a service route and discards its results for
+// the pods of the service. It must be called with the lock held.
+func (k *k8sServiceProxy) stopHealthCheck(svcID string, endpoint *svcEndpoint) {
+	if endpoint.healthStop != nil {
+		close(endpoint.healthStop)
+		endpoint.healthStop = nil
+	}
+	k.resetPodHealth(svcID, nil)
+}
+
+// resetPodHealth clears the health of the pods of a service that are not in probed. It
+// must be called with the lock held.
+func (k *k8sServiceProxy) resetPodHealth(svcID string, probed map[*podEndpoint]bool) {
+	data, exists := k.endpoints[svcID]
+	if !exists {
+		return
+	}
+	for _, e := range data.endpoints {
+		if !probed[e] {
+			e.Health = ""
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMakeHealthCheck(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				SvcProxyAnnotationHealthCheckPath:     "healthz",
+				SvcProxyAnnotationHealthCheckInterval: "30s",
+				SvcProxyAnnotationHealthCheckTimeout:  "forever",
+				SvcProxyAnnotationHealthCheckStatus:   "204",
+			},
+		},
+	}
+	hc := makeHealthCheck(svc)
+	expected := &healthCheck{
+		Path:     "/healthz",
+		Interval: 30 * time.Second,
+		Timeout:  defaultHealthCheckTimeout,
+		Status:   204,
+	}
+	if *hc != *expected {
+		t.Error(hc)
+	}
+
+	delete(svc.Annotations, SvcProxyAnnotationHealthCheckPath)
+	if hc := makeHealthCheck(svc); hc != nil {
+		t.Error(hc)
+	}
+}
+
+func TestHealthCheckService(t *testing.T) {
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Error(r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	port := testServerPort(server)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:                "/foo/",
+				SvcProxyAnnotationPort:                port,
+				SvcProxyAnnotationHealthCheckPath:     "/healthz",
+				SvcProxyAnnotationHealthCheckInterval: "10ms",
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+	defer k8s.serviceDelete(svc)
+
+	waitForCondition(t, k8s, func() bool {
+		return k8s.services["default/foo"].Health == healthStatusHealthy
+	})
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	waitForCondition(t, k8s, func() bool {
+		return k8s.services["default/foo"].Health == healthStatusUnhealthy
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost"+serviceDiscoveryPage, nil)
+	k8s.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"Health":"unhealthy"`) {
+		t.Error(rec.Body.String())
+	}
+}
+
+func TestHealthCheckPods(t *testing.T) {
+	hits := map[string]*int32{"foo-a": new(int32), "foo-b": new(int32)}
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	pods := newTestPods(t, k8s, func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if name == "foo-b" {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			atomic.AddInt32(hits[name], 1)
+		})
+	}, "foo-a", "foo-b")
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:                "/foo/",
+				SvcProxyAnnotationLoadBalancer:        loadBalancerRoundRobin,
+				SvcProxyAnnotationHealthCheckPath:     "/healthz",
+				SvcProxyAnnotationHealthCheckInterval: "10ms",
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+	defer k8s.serviceDelete(svc)
+
+	k8s.endpointUpdate(pods.endpoints([]string{"foo-a", "foo-b"}))
+
+	waitForCondition(t, k8s, func() bool {
+		pods := k8s.endpoints["default/foo"].endpoints
+		return pods[0].Health == healthStatusHealthy && pods[1].Health == healthStatusUnhealthy
+	})
+	k8s.Lock()
+	health := k8s.services["default/foo"].Health
+	k8s.Unlock()
+	if health != healthStatusHealthy {
+		t.Error(health)
+	}
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Error(rec.Code)
+		}
+	}
+	if n := atomic.LoadInt32(hits["foo-a"]); n != 4 {
+		t.Errorf("expected 4 requests to the healthy pod, got %d", n)
+	}
+
+	// Pods are no longer excluded once the health check is removed.
+	delete(svc.Annotations, SvcProxyAnnotationHealthCheckPath)
+	k8s.serviceChange(svc)
+	k8s.Lock()
+	health = k8s.endpoints["default/foo"].endpoints[1].Health
+	k8s.Unlock()
+	if health != "" {
+		t.Error(health)
+	}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+		k8s.ServeHTTP(rec, req)
+	}
+	if n := atomic.LoadInt32(hits["foo-b"]); n != 2 {
+		t.Errorf("expected 2 requests to the pod that was unhealthy, got %d", n)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// restConfig builds the configuration used to access the API server. It returns
+// true when the in-cluster configuration is used.
+func restConfig(opts *KubernetesOptions) (*rest.Config, bool, error) {
+	if opts.Kubeconfig == "" && opts.Context == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, true, nil
+		}
+		if err != rest.ErrNotInCluster {
+			return nil, false, err
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.Context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, false, err
+	}
+	return config, false, nil
+}
+
+// apiServerProxy generates URLs that reach services and pods through the
+// proxy subresource of the API server.
+type apiServerProxy struct {
+	base      *url.URL
+	config    *rest.Config
+	transport http.RoundTripper
+}
+
+func newAPIServerProxy(config *rest.Config) (*apiServerProxy, error) {
+	host := config.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	base, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return &apiServerProxy{base: base, config: config, transport: transport}, nil
+}
+
+// wrapTransport adds the TLS configuration and credentials of the API server to a
+// transport built for a service route.
+func (a *apiServerProxy) wrapTransport(t *http.Transport) (http.RoundTripper, error) {
+	tlsConfig, err := rest.TLSConfigFor(a.config)
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	return rest.HTTPWrappersForConfig(a.config, t)
+}
+
+func (a *apiServerProxy) proxyURL(namespace, resource, name string) *url.URL {
+	u := *a.base
+	u.Path = path.Join(a.base.Path, "/api/v1/namespaces", namespace, resource, name, "proxy")
+	return &u
+}
+
+func (a *apiServerProxy) serviceURL(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+	name := svc.Name
+	if endpoint.Port >= 0 {
+		name += fmt.Sprintf(":%d", endpoint.Port)
+	}
+	return a.proxyURL(svc.Namespace, "services", name)
+}
+
+// endpointURL addresses the pod by name; endpoints that do not refer to a pod
+// are not reachable.
+func (a *apiServerProxy) endpointURL(namespace string, endpoint *podEndpoint, port int) *url.URL {
+	if endpoint.PodName == "" {
+		return nil
+	}
+	return a.proxyURL(namespace, "pods", fmt.Sprintf("%s:%d", endpoint.PodName, port))
+}
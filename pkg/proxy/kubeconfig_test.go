@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: one
+  cluster:
+    server: https://one.example.com:6443
+- name: two
+  cluster:
+    server: https://two.example.com
+contexts:
+- name: one
+  context:
+    cluster: one
+    user: dev
+- name: two
+  context:
+    cluster: two
+    user: dev
+current-context: one
+users:
+- name: dev
+  user:
+    token: secret
+`
+
+func TestRestConfigKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(filename, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		context string
+		host    string
+	}{
+		{"", "https://one.example.com:6443"},
+		{"two", "https://two.example.com"},
+	}
+	for _, test := range testCases {
+		config, inCluster, err := restConfig(&KubernetesOptions{Kubeconfig: filename, Context: test.context})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inCluster {
+			t.Error("Expected out of cluster configuration")
+		}
+		if config.Host != test.host {
+			t.Errorf("Expected %s, got %s", test.host, config.Host)
+		}
+	}
+
+	if _, _, err := restConfig(&KubernetesOptions{Kubeconfig: filename, Context: "three"}); err == nil {
+		t.Error("Expected error for unknown context")
+	}
+}
+
+func TestAPIServerProxy(t *testing.T) {
+	var pathlist []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathlist = append(pathlist, r.URL.Path)
+		if r.URL.Path == "/api/v1/namespaces/default/services/foo:8080/proxy/bar/" {
+			// The API server rewrites the redirects of the backend into its own path space.
+			http.Redirect(w, r, "/api/v1/namespaces/default/services/foo:8080/proxy/bar/index.html", http.StatusSeeOther)
+		}
+	}))
+	defer server.Close()
+
+	apiServer, err := newAPIServerProxy(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = apiServer.serviceURL
+	k8s.makeEndpointURL = apiServer.endpointURL
+	k8s.transport = apiServer.transport
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:     "/foo/",
+				SvcProxyAnnotationPort:     "8080",
+				SvcProxyAnnotationMap:      "/bar/",
+				SvcProxyAnnotationEndpoint: "9000",
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+	k8s.addEndpointPort(svc)
+	k8s.endpointUpdate(&v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "foo-xyz"}},
+				},
+			},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo/", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Error(rec.Code)
+	}
+	if location := rec.Header().Get("Location"); location != "/foo/index.html" {
+		t.Errorf("Expected /foo/index.html, got %s", location)
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://localhost/endpoint/default/foo/0/debug/vars", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error(rec.Code)
+	}
+
+	expected := []string{
+		"/api/v1/namespaces/default/services/foo:8080/proxy/bar/",
+		"/api/v1/namespaces/default/pods/foo-xyz:9000/proxy/debug/vars",
+	}
+	if !reflect.DeepEqual(pathlist, expected) {
+		t.Error(pathlist)
+	}
+}
+
+func TestTrimLocationPrefix(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Location", "https://apiserver/api/v1/namespaces/default/services/foo/proxy/x/index.html?q=1")
+	trimLocationPrefix(resp, "/api/v1/namespaces/default/services/foo/proxy")
+	if location := resp.Header.Get("Location"); location != "/x/index.html?q=1" {
+		t.Error(location)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -13,30 +14,122 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 // SvcProxyHTTPPath is the http request path served by the proxy itself.
 const SvcProxyHTTPPath = "/k8s-svc-proxy/"
 
 type svcEndpoint struct {
+	Host        string `json:",omitempty"`
+	Priority    int32  `json:",omitempty"`
 	Path        string
 	Port        int32
 	Map         string
 	Description string
-	handler     http.Handler
+	// Match restricts the requests served by the route, beyond the path prefix.
+	Match        *routeMatch `json:",omitempty"`
+	LoadBalancer string      `json:",omitempty"`
+	Affinity     string      `json:",omitempty"`
+	// Rewrite describes the rewrite rules of the route.
+	Rewrite string `json:",omitempty"`
+	// RewriteBody lists the kinds of responses (html, css, js) whose links are mapped back
+	// to the path of the route.
+	RewriteBody []string `json:",omitempty"`
+	// Mirror is the service that receives a copy of the requests of the route.
+	Mirror string `json:",omitempty"`
+	// PortError describes why no port of the service is used by the route.
+	PortError  string `json:",omitempty"`
+	TargetPort int32  `json:",omitempty"`
+	// TargetPortName is the named targetPort of the route, resolved for each pod from the
+	// endpoints of the service, where it is listed under endpointPortName.
+	TargetPortName   string `json:",omitempty"`
+	endpointPortName string
+	// Health is the result of the last health check of the route.
+	Health string `json:",omitempty"`
+	// Breaker is the circuit breaker of routes that use the service address.
+	Breaker *circuitBreaker `json:",omitempty"`
+	// Conflicted is set when the route is served by ConflictsWith, a service that
+	// takes precedence.
+	Conflicted    bool   `json:",omitempty"`
+	ConflictsWith string `json:",omitempty"`
+	// Weight is the share of the traffic of a route split between weighted services,
+	// and Traffic the resulting percentage.
+	Weight        int32  `json:",omitempty"`
+	Traffic       string `json:",omitempty"`
+	weighted      bool
+	id            string
+	created       time.Time
+	ref           *v1.ObjectReference
+	target        *url.URL
+	handler       http.Handler
+	healthCheck   *healthCheck
+	healthStop    chan struct{}
+	breakerConfig *breakerConfig
+	// transport is used by the handlers of the route.
+	transport       http.RoundTripper
+	transportConfig *transportConfig
+	mirrorConfig    *mirrorConfig
+	rewrite         *rewriteConfig
+}
+
+// equivalent compares a route with its new configuration under the lock, since the health
+// check of the route updates its status.
+func (k *k8sServiceProxy) equivalent(prev, endpoint *svcEndpoint) bool {
+	k.Lock()
+	defer k.Unlock()
+	return prev.equivalent(endpoint)
+}
+
+// equivalent returns true when both endpoints have the same configuration.
+func (e *svcEndpoint) equivalent(other *svcEndpoint) bool {
+	a, b := *e, *other
+	a.handler, b.handler = nil, nil
+	a.Health, b.Health = "", ""
+	a.healthStop, b.healthStop = nil, nil
+	a.Breaker, b.Breaker = nil, nil
+	a.transport, b.transport = nil, nil
+	a.Conflicted, b.Conflicted = false, false
+	a.ConflictsWith, b.ConflictsWith = "", ""
+	a.Traffic, b.Traffic = "", ""
+	// The rewrite rules are compared by their description.
+	a.rewrite, b.rewrite = nil, nil
+	return reflect.DeepEqual(a, b)
 }
 
 type podEndpoint struct {
 	PodName string
 	IP      string
-	handler http.Handler
+	Ready   bool
+	// Health is the result of the last health check of the pod.
+	Health string `json:",omitempty"`
+	// Breaker ejects the pod from a balanced service route after consecutive failures.
+	Breaker *circuitBreaker `json:",omitempty"`
+	// Ports holds the ports of the pod exposed under /endpoint by name; the default port
+	// has an empty name.
+	Ports map[string]int `json:",omitempty"`
+	// portNames maps the names of the ports of the endpoint to their numbers.
+	portNames map[string]int
+	// handlers proxies requests to the pod, by port.
+	handlers map[int]http.Handler
+	// outstanding is the number of requests in progress when the pod is
+	// selected by a service load balancer.
+	outstanding int32
+	// lbHandler proxies the requests of lbEndpoint, the load balanced
+	// service route, to this pod.
+	lbHandler  http.Handler
+	lbEndpoint *svcEndpoint
 }
 
 type podEndpointSorter []*podEndpoint
@@ -46,17 +139,46 @@ func (a podEndpointSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a podEndpointSorter) Less(i, j int) bool { return a[i].PodName < a[j].PodName }
 
 type endpointData struct {
-	Port      int
-	endpoints []*podEndpoint
+	// Port is the default port exposed under /endpoint.
+	Port int
+	// NamedPorts are the ports exposed under /endpoint with a name.
+	NamedPorts []*endpointPort
+	endpoints  []*podEndpoint
 }
 
 type k8sServiceProxy struct {
 	sync.Mutex
-	pathHandlers   map[string][]http.Handler
+	// svcUpdateMutex serializes service events delivered by the informers of
+	// different namespaces.
+	svcUpdateMutex sync.Mutex
+	// pathHandlers holds the services that claim each path, in order of precedence.
+	pathHandlers map[string][]*svcEndpoint
+	// hostHandlers holds the path routes of each host.
+	hostHandlers map[string]map[string][]*svcEndpoint
+	// routes holds the *routeSnapshot used to match requests; it is replaced
+	// whenever the route tables change.
+	routes         atomic.Value
 	services       map[string]*svcEndpoint
 	endpoints      map[string]*endpointData
+	endpointSlices map[string]map[string][]*podEndpoint
 	defaultHandler http.Handler
 	makeServiceURL func(*v1.Service, *svcEndpoint) *url.URL
+	// makeEndpointURL returns the URL of a pod given its namespace and port.
+	makeEndpointURL func(string, *podEndpoint, int) *url.URL
+	// transport is used to reach the backends; nil selects http.DefaultTransport.
+	transport http.RoundTripper
+	// recorder reports events on services; nil disables events.
+	recorder record.EventRecorder
+	// status writes the status annotation of services; nil disables it.
+	status *statusWriter
+	// invalidAnnotations describes the invalid annotations of each service.
+	invalidAnnotations map[string]string
+	// statusChanged holds the services whose route status changed as a result
+	// of a change to another service.
+	statusChanged map[string]bool
+	// wrapTransport adds the credentials required to reach the backends to the
+	// transports built for service routes; nil leaves them unchanged.
+	wrapTransport func(*http.Transport) (http.RoundTripper, error)
 }
 
 const (
@@ -67,7 +189,63 @@ const (
 	// to add a specific string to the list of paths handled by this proxy.
 	SvcProxyAnnotationPath = SvcProxyAnnotationPrefix + "path"
 
-	// SvcProxyAnnotationPort (optional) specifies the HTTP port to forward traffic to.
+	// SvcProxyAnnotationHost (optional) restricts the route to requests for the specified host name.
+	// A leading "*." matches any subdomain. When set, the path annotation defaults to "/".
+	SvcProxyAnnotationHost = SvcProxyAnnotationPrefix + "host"
+
+	// SvcProxyAnnotationPriority (optional) resolves conflicts between services that claim the same
+	// route: the service with the highest priority serves it. Services with the same priority are
+	// ordered by creation time, oldest first.
+	SvcProxyAnnotationPriority = SvcProxyAnnotationPrefix + "priority"
+
+	// SvcProxyAnnotationWeight (optional) splits the traffic of a route between the services that
+	// claim it, in proportion to their weights, instead of using the service that takes precedence.
+	SvcProxyAnnotationWeight = SvcProxyAnnotationPrefix + "weight"
+
+	// SvcProxyAnnotationRewrite (optional) is a list of rewrite rules, one per line, of the form
+	// "<regexp> <replacement>". The first rule that matches the request path replaces it with the
+	// replacement, which may refer to capture groups as $1 or ${1} and may include a query string.
+	// Rules are inverted, where possible, to translate Location headers.
+	SvcProxyAnnotationRewrite = SvcProxyAnnotationPrefix + "rewrite"
+
+	// SvcProxyAnnotationRewriteQuery (optional) is a comma separated list of edits applied to the
+	// query string of requests: "name=value" sets a parameter and "-name" removes it.
+	SvcProxyAnnotationRewriteQuery = SvcProxyAnnotationPrefix + "rewrite-query"
+
+	// SvcProxyAnnotationRewriteBody (optional) is a comma separated list of the kinds of responses,
+	// among html, css and js, in which links to the map prefix are rewritten to the path of the route.
+	SvcProxyAnnotationRewriteBody = SvcProxyAnnotationPrefix + "rewrite-body"
+
+	// SvcProxyAnnotationMirror (optional) names a service, as [namespace/]name[:port], that receives
+	// a copy of the requests of the route. Mirrored responses are discarded.
+	SvcProxyAnnotationMirror = SvcProxyAnnotationPrefix + "mirror"
+
+	// SvcProxyAnnotationMirrorPercent (optional) is the percentage of the requests that are
+	// mirrored (default 100).
+	SvcProxyAnnotationMirrorPercent = SvcProxyAnnotationPrefix + "mirror-percent"
+
+	// SvcProxyAnnotationMirrorMaxBody (optional) is the largest request body, in bytes, that is
+	// buffered for mirroring (default 65536). Requests with larger bodies are not mirrored.
+	SvcProxyAnnotationMirrorMaxBody = SvcProxyAnnotationPrefix + "mirror-max-body"
+
+	// SvcProxyAnnotationMatchMethods (optional) is a comma separated list of the HTTP methods
+	// served by the route, e.g. "GET,HEAD".
+	SvcProxyAnnotationMatchMethods = SvcProxyAnnotationPrefix + "match-methods"
+
+	// SvcProxyAnnotationMatchHeaders (optional) is a comma separated list of request headers that
+	// must be present, as "Name" or "Name=value", for the route to serve a request.
+	SvcProxyAnnotationMatchHeaders = SvcProxyAnnotationPrefix + "match-headers"
+
+	// SvcProxyAnnotationMatchQuery (optional) is a comma separated list of query parameters that
+	// must be present, as "name" or "name=value", for the route to serve a request.
+	SvcProxyAnnotationMatchQuery = SvcProxyAnnotationPrefix + "match-query"
+
+	// SvcProxyAnnotationStatus is written by the proxy, when enabled, to describe the routes of
+	// the service and any problems with its annotations.
+	SvcProxyAnnotationStatus = SvcProxyAnnotationPrefix + "status"
+
+	// SvcProxyAnnotationPort (optional) specifies the HTTP port to forward traffic to, by number or
+	// by the name of a service port or of the container port it targets.
 	SvcProxyAnnotationPort = SvcProxyAnnotationPrefix + "port"
 
 	// SvcProxyAnnotationMap (optional) specifies a URL mapping by prefix.
@@ -77,26 +255,104 @@ const (
 	SvcProxyAnnotationDescription = SvcProxyAnnotationPrefix + "description"
 
 	// SvcProxyAnnotationEndpoint (optional) specifies that the endpoints of the service should be
-	// exposed under the /endpoint path.
+	// exposed under the /endpoint path. The value is a list of [name=]port entries; named ports
+	// are selected by the first segment of the request path and may refer to the name of a port
+	// of the endpoints.
 	SvcProxyAnnotationEndpoint = SvcProxyAnnotationPrefix + "endpoint-port"
 
+	// SvcProxyAnnotationLoadBalancer (optional) selects the policy used to balance requests
+	// across the ready pods of the service: round-robin, least-outstanding or random-two.
+	// By default requests are sent to the service address.
+	SvcProxyAnnotationLoadBalancer = SvcProxyAnnotationPrefix + "load-balancer"
+
+	// SvcProxyAnnotationAffinity (optional) pins clients to a pod of the service. Requests are
+	// hashed by "header:<name>", "cookie:<name>" or "source-ip"; "cookie" issues an affinity
+	// cookie that names the pod. Implies load balancing across the pods of the service.
+	SvcProxyAnnotationAffinity = SvcProxyAnnotationPrefix + "affinity"
+
+	// SvcProxyAnnotationHealthCheckPath (optional) enables an active health check of the service,
+	// or of each pod when the route is balanced by the proxy, using the specified request path.
+	SvcProxyAnnotationHealthCheckPath = SvcProxyAnnotationPrefix + "health-check-path"
+
+	// SvcProxyAnnotationHealthCheckInterval (optional) is the interval between health checks (default 10s).
+	SvcProxyAnnotationHealthCheckInterval = SvcProxyAnnotationPrefix + "health-check-interval"
+
+	// SvcProxyAnnotationHealthCheckTimeout (optional) is the timeout of a health check (default 2s).
+	SvcProxyAnnotationHealthCheckTimeout = SvcProxyAnnotationPrefix + "health-check-timeout"
+
+	// SvcProxyAnnotationHealthCheckStatus (optional) is the expected response status of a health
+	// check. By default any 2xx status is accepted.
+	SvcProxyAnnotationHealthCheckStatus = SvcProxyAnnotationPrefix + "health-check-status"
+
+	// SvcProxyAnnotationBreakerFailures (optional) enables a circuit breaker that opens after the
+	// specified number of consecutive 5xx responses or connection errors. Routes balanced by the
+	// proxy eject the failing pod instead.
+	SvcProxyAnnotationBreakerFailures = SvcProxyAnnotationPrefix + "circuit-breaker-failures"
+
+	// SvcProxyAnnotationBreakerEjectionTime (optional) is the time a circuit breaker stays open (default 30s).
+	SvcProxyAnnotationBreakerEjectionTime = SvcProxyAnnotationPrefix + "circuit-breaker-ejection-time"
+
+	// SvcProxyAnnotationMaxRequests (optional) limits the number of requests in progress for the service.
+	SvcProxyAnnotationMaxRequests = SvcProxyAnnotationPrefix + "max-requests"
+
+	// SvcProxyAnnotationConnectTimeout (optional) limits the time to establish a connection to the backend.
+	SvcProxyAnnotationConnectTimeout = SvcProxyAnnotationPrefix + "connect-timeout"
+
+	// SvcProxyAnnotationResponseHeaderTimeout (optional) limits the time to wait for the response headers.
+	SvcProxyAnnotationResponseHeaderTimeout = SvcProxyAnnotationPrefix + "response-header-timeout"
+
+	// SvcProxyAnnotationRequestTimeout (optional) limits the duration of a request, including the response body.
+	SvcProxyAnnotationRequestTimeout = SvcProxyAnnotationPrefix + "request-timeout"
+
+	// SvcProxyAnnotationIdleConnTimeout (optional) closes idle connections to the backend after the specified time.
+	SvcProxyAnnotationIdleConnTimeout = SvcProxyAnnotationPrefix + "idle-conn-timeout"
+
+	// SvcProxyAnnotationMaxIdleConns (optional) limits the number of idle connections to each backend.
+	SvcProxyAnnotationMaxIdleConns = SvcProxyAnnotationPrefix + "max-idle-conns"
+
+	// SvcProxyAnnotationRetries (optional) is the number of times an idempotent request is retried after
+	// a connection error or a 502, 503 or 504 response.
+	SvcProxyAnnotationRetries = SvcProxyAnnotationPrefix + "retries"
+
+	// SvcProxyAnnotationRetryBackoff (optional) is the delay before the first retry, doubled after each
+	// attempt (default 100ms).
+	SvcProxyAnnotationRetryBackoff = SvcProxyAnnotationPrefix + "retry-backoff"
+
 	serviceDiscoveryPage  = SvcProxyHTTPPath + "services"
 	endpointDiscoveryPage = SvcProxyHTTPPath + "endpoints"
 
 	endpointPath = "/endpoint/"
+	podPath      = "/pod/"
 )
 
+// mapPath translates the path of a request URL into the path space of the target, using
+// the rewrite rules of the route, the Map prefix or, without either, the request path.
+func mapPath(endpoint *svcEndpoint, target *url.URL, u *url.URL) {
+	if endpoint.rewrite != nil && endpoint.rewrite.apply(target.Path, u) {
+		return
+	}
+	if endpoint.Map != "" && strings.HasPrefix(u.Path, endpoint.Path) {
+		u.Path = target.Path + endpoint.Map + u.Path[len(endpoint.Path):]
+	} else {
+		u.Path = target.Path + u.Path
+	}
+	u.RawPath = ""
+}
+
 func requestMapper(endpoint *svcEndpoint, target *url.URL, req *http.Request) {
 	req.URL.Scheme = target.Scheme
 	req.URL.Host = target.Host
-	req.URL.Path = endpoint.Map + req.URL.Path[len(endpoint.Path):]
+	mapPath(endpoint, target, req.URL)
 	// explicitly disable User-Agent so it's not set to default value
 	if _, ok := req.Header["User-Agent"]; !ok {
 		req.Header.Set("User-Agent", "")
 	}
 }
 
-func invRemap(endpoint *svcEndpoint, requestURL *url.URL, pathValues []string) []string {
+// invRemap translates the URL paths in response headers into the path space of the proxy.
+// basePath is the path prefix of the service target URL, which is removed before the mapping
+// is reversed. The query string of the URLs is preserved.
+func invRemap(endpoint *svcEndpoint, basePath string, requestURL *url.URL, pathValues []string) []string {
 	var result []string
 	for _, upath := range pathValues {
 		base, err := url.Parse(requestURL.Path)
@@ -110,101 +366,233 @@ func invRemap(endpoint *svcEndpoint, requestURL *url.URL, pathValues []string) [
 			continue
 		}
 		r := base.ResolveReference(u)
-
-		if !strings.HasPrefix(r.Path, endpoint.Map) {
+		rpath := strings.TrimPrefix(r.Path, basePath)
+
+		var mapped string
+		if p, ok := endpoint.rewrite.invert(rpath); ok {
+			mapped = p
+		} else if endpoint.Map == "" {
+			mapped = rpath
+		} else if strings.HasPrefix(rpath, endpoint.Map) {
+			offset := len(endpoint.Map)
+			mapped = path.Join(endpoint.Path, rpath[offset:])
+		} else {
 			continue
 		}
-		offset := len(endpoint.Map)
-		result = append(result, path.Join(endpoint.Path, r.Path[offset:]))
+		if r.RawQuery != "" {
+			mapped += "?" + r.RawQuery
+		}
+		result = append(result, mapped)
 	}
 
 	return result
 }
 
+// otherHost reports whether a URL of a response of the backend refers to another host.
+func otherHost(backend *url.URL, value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && u.Host != "" && !strings.EqualFold(u.Host, backend.Host)
+}
+
 func (k *k8sServiceProxy) newProxyHandler(target *url.URL, endpoint *svcEndpoint) http.Handler {
 	var proxy http.Handler
-	if endpoint.Map != "" {
+	if endpoint.Map != "" || endpoint.rewrite != nil {
 		director := func(req *http.Request) {
 			requestMapper(endpoint, target, req)
 		}
 		headerRemapper := func(resp *http.Response) error {
-			if location, ok := resp.Header["Location"]; ok {
-				nloc := invRemap(endpoint, resp.Request.URL, location)
+			// Redirects to other hosts, e.g. to a login page, are not paths of the backend.
+			if location, ok := resp.Header["Location"]; ok && !otherHost(resp.Request.URL, location[0]) {
+				nloc := invRemap(endpoint, target.Path, resp.Request.URL, location)
 				if len(nloc) == 0 {
 					return fmt.Errorf("Unable to remap %s %s", resp.Request.URL.String(), location)
 				}
 				resp.Header["Location"] = nloc
 			}
-			return nil
+			remapResponseHeaders(endpoint, target.Path, resp)
+			return rewriteResponseBody(endpoint, resp)
 		}
 		proxy = &httputil.ReverseProxy{
-			Director: director, ModifyResponse: headerRemapper}
+			Director: director, ModifyResponse: headerRemapper, Transport: endpoint.transport,
+			ErrorHandler: proxyErrorHandler}
 	} else {
-		proxy = httputil.NewSingleHostReverseProxy(target)
+		rp := httputil.NewSingleHostReverseProxy(target)
+		rp.Transport = endpoint.transport
+		rp.ErrorHandler = proxyErrorHandler
+		if target.Path != "" || endpoint.Host != "" {
+			rp.ModifyResponse = func(resp *http.Response) error {
+				if target.Path != "" {
+					trimLocationPrefix(resp, target.Path)
+				}
+				remapCookies(endpoint, resp, trimCookiePath(target.Path))
+				return nil
+			}
+		}
+		proxy = rp
 	}
 	return proxy
 }
 
-func makeEndpointProxy(scheme, host string) http.Handler {
-	director := func(req *http.Request) {
-		if scheme == "" {
-			scheme = "http"
+// trimLocationPrefix removes the path prefix of the target URL from redirects
+// generated by the backend.
+func trimLocationPrefix(resp *http.Response, prefix string) {
+	location, ok := resp.Header["Location"]
+	if !ok {
+		return
+	}
+	for i, value := range location {
+		u, err := url.Parse(value)
+		if err != nil || !strings.HasPrefix(u.Path, prefix) {
+			continue
 		}
-		req.URL.Scheme = scheme
-		req.URL.Host = host
-		path := strings.SplitN(req.URL.Path[1:], "/", 5)
-		req.URL.Path = "/" + path[4]
+		u.Scheme = ""
+		u.Host = ""
+		u.RawPath = ""
+		u.Path = u.Path[len(prefix):]
+		location[i] = u.String()
+	}
+}
+
+func makeEndpointProxy(target *url.URL, transport http.RoundTripper) http.Handler {
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = target.Path + req.URL.Path
 
 		if _, ok := req.Header["User-Agent"]; !ok {
 			req.Header.Set("User-Agent", "")
 		}
 	}
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{Director: director, Transport: transport}
+}
+
+func makeEndpointURL(namespace string, endpoint *podEndpoint, port int) *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(endpoint.IP, strconv.Itoa(port)),
+	}
+}
+
+// endpointHandler returns the handler that proxies requests to a port of a pod of a
+// service, creating it when needed, and the path of the request. The port is selected
+// by the first segment of the request path. It must be called with the lock held.
+func (k *k8sServiceProxy) endpointHandler(key string, endpoint *podEndpoint, path string) (http.Handler, string) {
+	port, path := endpoint.selectPort(path)
+	if port <= 0 {
+		return nil, ""
+	}
+	if handler, exists := endpoint.handlers[port]; exists {
+		return handler, path
+	}
+	namespace := key[:strings.Index(key, "/")]
+	target := k.makeEndpointURL(namespace, endpoint, port)
+	if target == nil {
+		return nil, ""
+	}
+	if endpoint.handlers == nil {
+		endpoint.handlers = make(map[int]http.Handler)
+	}
+	handler := makeEndpointProxy(target, k.transport)
+	endpoint.handlers[port] = handler
+	return handler, path
 }
 
-// getEndpointWithHandler encloses the portion of serveEndpoint that runs under the lock
+// findEndpoint looks up a pod of a service by name or, when no pod has that name, by its
+// index in the list of pods sorted by name.
+func findEndpoint(list []*podEndpoint, id string) *podEndpoint {
+	for _, endpoint := range list {
+		if endpoint.PodName == id {
+			return endpoint
+		}
+	}
+	index, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || index >= uint64(len(list)) {
+		return nil
+	}
+	return list[index]
+}
+
+// getEndpointHandler encloses the portion of serveEndpoint that runs under the lock
 // since it access shared datastructures.
-func (k *k8sServiceProxy) getEndpointWithHandler(key string, id int, scheme string) *podEndpoint {
+func (k *k8sServiceProxy) getEndpointHandler(key, id, path string) (http.Handler, string) {
 	k.Lock()
 	defer k.Unlock()
 
 	data, exists := k.endpoints[key]
-	if !exists || data.Port <= 0 {
-		return nil
+	if !exists || !data.exposed() {
+		return nil, ""
 	}
-	list := data.endpoints
-	if id >= len(list) {
-		return nil
+	endpoint := findEndpoint(data.endpoints, id)
+	if endpoint == nil {
+		return nil, ""
 	}
+	return k.endpointHandler(key, endpoint, path)
+}
+
+// getPodHandler returns the handler of a pod of a service of the namespace that exposes
+// its endpoints. When several services select the pod, the first by name is used.
+func (k *k8sServiceProxy) getPodHandler(namespace, podName, path string) (http.Handler, string) {
+	k.Lock()
+	defer k.Unlock()
 
-	endpoint := list[id]
-	if endpoint.handler == nil {
-		host := fmt.Sprintf("%s:%d", endpoint.IP, data.Port)
-		endpoint.handler = makeEndpointProxy(scheme, host)
+	var keys []string
+	for key, data := range k.endpoints {
+		if strings.HasPrefix(key, namespace+"/") && data.exposed() {
+			keys = append(keys, key)
+		}
 	}
-	return endpoint
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, endpoint := range k.endpoints[key].endpoints {
+			if endpoint.PodName == podName {
+				return k.endpointHandler(key, endpoint, path)
+			}
+		}
+	}
+	return nil, ""
+}
+
+// serveEndpointPath proxies a request to a pod with the path that follows the endpoint
+// prefix.
+func serveEndpointPath(w http.ResponseWriter, r *http.Request, handler http.Handler, path string) {
+	req := new(http.Request)
+	*req = *r
+	req.URL = new(url.URL)
+	*req.URL = *r.URL
+	req.URL.Path = "/" + path
+	req.URL.RawPath = ""
+	handler.ServeHTTP(w, req)
 }
 
 func (k *k8sServiceProxy) serveEndpoint(w http.ResponseWriter, r *http.Request) {
-	// /endpoint/<namespace>/service/id/request-path
+	// /endpoint/<namespace>/service/<pod-name or id>/[port-name/]request-path
 	parts := strings.SplitN(r.URL.Path[1:], "/", 5)
 	if len(parts) < 5 {
 		http.Error(w, r.URL.Path, http.StatusNotFound)
 		return
 	}
 	key := strings.Join(parts[1:3], "/")
-	id, err := strconv.ParseUint(parts[3], 10, 32)
-	if err != nil {
-		http.Error(w, parts[3], http.StatusNotFound)
+	handler, path := k.getEndpointHandler(key, parts[3], parts[4])
+	if handler == nil {
+		http.Error(w, fmt.Sprintf("No endpoint %s of service %s", parts[3], key), http.StatusNotFound)
 		return
 	}
+	serveEndpointPath(w, r, handler, path)
+}
 
-	endpoint := k.getEndpointWithHandler(key, int(id), r.URL.Scheme)
-	if endpoint == nil {
-		http.Error(w, key, http.StatusNotFound)
+func (k *k8sServiceProxy) servePod(w http.ResponseWriter, r *http.Request) {
+	// /pod/<namespace>/<pod-name>/[port-name/]request-path
+	parts := strings.SplitN(r.URL.Path[1:], "/", 4)
+	if len(parts) < 4 {
+		http.Error(w, r.URL.Path, http.StatusNotFound)
 		return
 	}
-	endpoint.handler.ServeHTTP(w, r)
+	handler, path := k.getPodHandler(parts[1], parts[2], parts[3])
+	if handler == nil {
+		http.Error(w, fmt.Sprintf("No endpoint for pod %s/%s", parts[1], parts[2]), http.StatusNotFound)
+		return
+	}
+	serveEndpointPath(w, r, handler, path)
 }
 
 // ServeHttp implements the http.Handler interface.
@@ -219,27 +607,50 @@ func (k *k8sServiceProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if strings.HasPrefix(req.URL.Path, endpointPath) {
-		k.serveEndpoint(rw, req)
-		return
-	}
-
-	var bestMatch string
 	handler := k.defaultHandler
-	k.Lock()
-	for k, v := range k.pathHandlers {
-		if strings.HasPrefix(req.URL.Path, k) && len(k) > len(bestMatch) {
-			bestMatch = k
-			handler = v[0]
-		}
+	if h := k.matchRoute(req); h != nil {
+		handler = h
 	}
-	k.Unlock()
 
 	handler.ServeHTTP(rw, req)
 }
 
+// endpointPage returns the handler of the pages of the proxy that serve the pods of a
+// service, or nil when the path is not one of them.
+func (k *k8sServiceProxy) endpointPage(path string) http.Handler {
+	switch {
+	case strings.HasPrefix(path, endpointPath):
+		return http.HandlerFunc(k.serveEndpoint)
+	case strings.HasPrefix(path, podPath):
+		return http.HandlerFunc(k.servePod)
+	case strings.HasPrefix(path, fanoutPath):
+		return http.HandlerFunc(k.serveFanout)
+	}
+	return nil
+}
+
+// reservedPrefix returns the prefix served by the proxy itself that holds the path of a
+// route, or "" when there is none. The pages of the proxy are served for every host; the
+// endpoint pages only to requests that no host route selects.
+func reservedPrefix(path string, hostRoute bool) string {
+	if strings.HasPrefix(path, SvcProxyHTTPPath) {
+		return SvcProxyHTTPPath
+	}
+	if hostRoute {
+		return ""
+	}
+	for _, prefix := range []string{endpointPath, podPath, fanoutPath} {
+		if strings.HasPrefix(path, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
 func (k *k8sServiceProxy) serviceStatus(w http.ResponseWriter, r *http.Request) {
+	k.Lock()
 	js, err := json.Marshal(k.services)
+	k.Unlock()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -250,21 +661,25 @@ func (k *k8sServiceProxy) serviceStatus(w http.ResponseWriter, r *http.Request)
 
 // EndpointStatus is the status information corresponding to service backends.
 type EndpointStatus struct {
-	Name     string
-	Port     int
-	Backends []*podEndpoint
+	Name       string
+	Port       int
+	NamedPorts []*endpointPort `json:",omitempty"`
+	Backends   []*podEndpoint
 }
 
 func (k *k8sServiceProxy) endpointStatus(w http.ResponseWriter, r *http.Request) {
+	k.Lock()
+	defer k.Unlock()
 	var endpointStatus []*EndpointStatus
 	for k, v := range k.endpoints {
-		if v.Port == 0 {
+		if !v.exposed() {
 			continue
 		}
 		endpointStatus = append(endpointStatus, &EndpointStatus{
-			Name:     k,
-			Port:     v.Port,
-			Backends: v.endpoints,
+			Name:       k,
+			Port:       v.Port,
+			NamedPorts: v.NamedPorts,
+			Backends:   v.endpoints,
 		})
 	}
 
@@ -277,54 +692,139 @@ func (k *k8sServiceProxy) endpointStatus(w http.ResponseWriter, r *http.Request)
 	w.Write(js)
 }
 
-func getServicePort(svc *v1.Service) (int32, bool) {
-	if port, exists := svc.Annotations[SvcProxyAnnotationPort]; exists {
-		p, err := strconv.Atoi(port)
-		if err != nil {
-			log.Printf("Invalid annotation (%s) for %s/%s", port, svc.Namespace, svc.Name)
-			return -1, false
+// getServicePort returns the service port used by a route: the port annotation, given by
+// number or by the name of a service port or of the container port that it targets, or the
+// only port of the service. Otherwise it returns -1, which selects the default HTTP port,
+// along with the reason why no port of the service can be used.
+func getServicePort(svc *v1.Service) (int32, string) {
+	if value, exists := svc.Annotations[SvcProxyAnnotationPort]; exists {
+		if p, err := strconv.Atoi(value); err == nil {
+			return int32(p), ""
 		}
-		return int32(p), true
-	} else if len(svc.Spec.Ports) == 1 {
-		svcPort := svc.Spec.Ports[0]
-		if svcPort.Port != 80 {
-			return svcPort.Port, true
+		for _, svcPort := range svc.Spec.Ports {
+			if svcPort.Name == value || svcPort.TargetPort.Type == intstr.String && svcPort.TargetPort.StrVal == value {
+				return svcPort.Port, ""
+			}
 		}
+		return -1, fmt.Sprintf("%q is not the name of a port of the service", value)
+	}
+	switch len(svc.Spec.Ports) {
+	case 0:
+		return -1, ""
+	case 1:
+		return svc.Spec.Ports[0].Port, ""
 	}
-	return -1, false
+	return -1, fmt.Sprintf("the service has %d ports and no %s annotation", len(svc.Spec.Ports), SvcProxyAnnotationPort)
 }
 
 func makeSvcEndpoint(svc *v1.Service) *svcEndpoint {
-	path, exists := svc.Annotations[SvcProxyAnnotationPath]
-	if !exists {
+	path, pathExists := svc.Annotations[SvcProxyAnnotationPath]
+	host, hostExists := svc.Annotations[SvcProxyAnnotationHost]
+	if !pathExists && !hostExists {
 		return nil
 	}
-	if strings.HasPrefix(path, SvcProxyHTTPPath) {
+	if !pathExists {
+		path = "/"
+	}
+	var err error
+	if path, err = expandServiceVars(svc, path); err != nil {
+		log.Printf("Invalid annotation %s for %s/%s: %v", SvcProxyAnnotationPath, svc.Namespace, svc.Name, err)
 		return nil
 	}
-	vars := map[string]string{
-		"NAME":      svc.Name,
-		"NAMESPACE": svc.Namespace,
+	if host, err = expandServiceVars(svc, host); err != nil {
+		log.Printf("Invalid annotation %s for %s/%s: %v", SvcProxyAnnotationHost, svc.Namespace, svc.Name, err)
+		return nil
+	}
+	if prefix := reservedPrefix(path, host != ""); prefix != "" {
+		log.Printf("Invalid annotation %s (%s) for %s/%s: %s is served by the proxy", SvcProxyAnnotationPath, path, svc.Namespace, svc.Name, prefix)
+		return nil
 	}
-	path = ExpandVars(vars, path)
 	endpoint := &svcEndpoint{
-		Path: path,
-		Port: -1,
+		Host:    strings.TrimSuffix(strings.ToLower(host), "."),
+		Path:    path,
+		Port:    -1,
+		id:      svc.Namespace + "/" + svc.Name,
+		created: svc.CreationTimestamp.Time,
+		ref:     serviceReference(svc),
+	}
+	if priority, isSet := svc.Annotations[SvcProxyAnnotationPriority]; isSet {
+		if p, err := strconv.ParseInt(priority, 10, 32); err == nil {
+			endpoint.Priority = int32(p)
+		} else {
+			log.Printf("Invalid annotation %s (%s) for %s/%s", SvcProxyAnnotationPriority, priority, svc.Namespace, svc.Name)
+		}
 	}
-	if port, isSet := getServicePort(svc); isSet {
-		endpoint.Port = port
+	if endpoint.Port, endpoint.PortError = getServicePort(svc); endpoint.PortError != "" {
+		log.Printf("No port for %s/%s: %s; using the default HTTP port", svc.Namespace, svc.Name, endpoint.PortError)
 	}
+	var valid bool
+	if endpoint.Match, valid = makeRouteMatch(svc); !valid {
+		return nil
+	}
+	endpoint.Weight, endpoint.weighted = makeWeight(svc)
 	if mapPrefix, isSet := svc.Annotations[SvcProxyAnnotationMap]; isSet {
-		endpoint.Map = mapPrefix
+		if endpoint.Map, err = expandServiceVars(svc, mapPrefix); err != nil {
+			log.Printf("Invalid annotation %s for %s/%s: %v", SvcProxyAnnotationMap, svc.Namespace, svc.Name, err)
+			return nil
+		}
 	}
 	if desc, isSet := svc.Annotations[SvcProxyAnnotationDescription]; isSet {
-		endpoint.Description = desc
+		if endpoint.Description, err = expandServiceVars(svc, desc); err != nil {
+			// The description is only shown in the status page; the route is kept.
+			log.Printf("Invalid annotation %s for %s/%s: %v", SvcProxyAnnotationDescription, svc.Namespace, svc.Name, err)
+			endpoint.Description = desc
+		}
+	}
+	if policy, isSet := svc.Annotations[SvcProxyAnnotationLoadBalancer]; isSet {
+		endpoint.LoadBalancer = policy
+	}
+	if affinity, isSet := svc.Annotations[SvcProxyAnnotationAffinity]; isSet {
+		endpoint.Affinity = affinity
+	}
+	if endpoint.LoadBalancer != "" || endpoint.Affinity != "" {
+		endpoint.TargetPort, endpoint.TargetPortName, endpoint.endpointPortName = getTargetPort(svc, endpoint.Port)
+	}
+	endpoint.healthCheck = makeHealthCheck(svc)
+	endpoint.breakerConfig = makeBreakerConfig(svc)
+	endpoint.transportConfig = makeTransportConfig(svc)
+	endpoint.RewriteBody = makeBodyRewrite(svc)
+	if endpoint.rewrite = makeRewriteConfig(svc); endpoint.rewrite != nil {
+		endpoint.Rewrite = endpoint.rewrite.String()
+	}
+	if endpoint.mirrorConfig = makeMirrorConfig(svc); endpoint.mirrorConfig != nil {
+		endpoint.Mirror = endpoint.mirrorConfig.String()
 	}
 	return endpoint
 }
 
+// getTargetPort returns the pod port that corresponds to a service port. Ports that are
+// not defined by the service are assumed to be pod ports. Routes that do not specify a
+// port use the default HTTP port. A named targetPort is returned as -1 along with its name
+// and the name of the service port, which lists the port of each pod in the endpoints.
+func getTargetPort(svc *v1.Service, port int32) (int32, string, string) {
+	if port < 0 {
+		port = 80
+	}
+	for _, svcPort := range svc.Spec.Ports {
+		if svcPort.Port != port {
+			continue
+		}
+		if svcPort.TargetPort.Type != intstr.Int {
+			return -1, svcPort.TargetPort.StrVal, svcPort.Name
+		}
+		if svcPort.TargetPort.IntVal == 0 {
+			return svcPort.Port, "", ""
+		}
+		return svcPort.TargetPort.IntVal, "", ""
+	}
+	return port, "", ""
+}
+
 func makeServiceURL(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
 	schemeHost := fmt.Sprintf("http://%s.%s.svc", svc.Name, svc.Namespace)
+	if svc.Spec.Type == v1.ServiceTypeExternalName && svc.Spec.ExternalName != "" {
+		schemeHost = "http://" + svc.Spec.ExternalName
+	}
 	if endpoint.Port >= 0 {
 		schemeHost += fmt.Sprintf(":%d", endpoint.Port)
 	}
@@ -337,17 +837,6 @@ func makeServiceURL(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
 	return u
 }
 
-func handlerListRemove(list []http.Handler, element http.Handler) []http.Handler {
-	for i, h := range list {
-		if h == element {
-			list[i] = list[len(list)-1]
-			list = list[:len(list)-1]
-			break
-		}
-	}
-	return list
-}
-
 func (k *k8sServiceProxy) serviceAdd(svc *v1.Service) {
 	endpoint := makeSvcEndpoint(svc)
 	if endpoint == nil {
@@ -357,25 +846,25 @@ func (k *k8sServiceProxy) serviceAdd(svc *v1.Service) {
 	svcID := svc.Namespace + "/" + svc.Name
 	log.Print("ADD service ", svcID)
 
+	endpoint.target = k.makeServiceURL(svc, endpoint)
 	if prev, dup := k.services[svcID]; dup {
 		log.Printf("ADD event for existing service %s", svcID)
-		if reflect.DeepEqual(endpoint, prev) {
+		if k.equivalent(prev, endpoint) {
 			return
 		}
-		delete(k.pathHandlers, endpoint.Path)
-	}
-
-	if _, dup := k.pathHandlers[endpoint.Path]; dup {
-		log.Printf("Duplicate %s annotation for %s: %s/%s", SvcProxyAnnotationPath, endpoint.Path, svc.Namespace, svc.Name)
+		k.Lock()
+		k.stopHealthCheck(svcID, prev)
+		k.removeRoute(prev)
+		k.Unlock()
 	}
 
-	u := k.makeServiceURL(svc, endpoint)
-	endpoint.handler = k.newProxyHandler(u, endpoint)
+	endpoint.handler = k.newServiceHandler(svcID, endpoint)
 
 	k.Lock()
 	defer k.Unlock()
-	k.pathHandlers[endpoint.Path] = append(k.pathHandlers[endpoint.Path], endpoint.handler)
+	k.addRoute(endpoint)
 	k.services[svcID] = endpoint
+	k.startHealthCheck(svcID, endpoint)
 }
 
 func (k *k8sServiceProxy) serviceDelete(svc *v1.Service) {
@@ -384,11 +873,9 @@ func (k *k8sServiceProxy) serviceDelete(svc *v1.Service) {
 	k.Lock()
 	defer k.Unlock()
 	if endpoint, exists := k.services[svcID]; exists {
+		k.stopHealthCheck(svcID, endpoint)
 		delete(k.services, svcID)
-		k.pathHandlers[endpoint.Path] = handlerListRemove(k.pathHandlers[endpoint.Path], endpoint.handler)
-		if len(k.pathHandlers[endpoint.Path]) == 0 {
-			delete(k.pathHandlers, endpoint.Path)
-		}
+		k.removeRoute(endpoint)
 	}
 }
 
@@ -398,21 +885,23 @@ func (k *k8sServiceProxy) serviceChange(svc *v1.Service) {
 	endpoint := makeSvcEndpoint(svc)
 
 	if prev != nil && endpoint != nil {
-		if reflect.DeepEqual(prev, endpoint) {
+		endpoint.target = k.makeServiceURL(svc, endpoint)
+		if k.equivalent(prev, endpoint) {
 			return
 		}
 
 		log.Print("CHANGE service ", svcID)
-		u := k.makeServiceURL(svc, endpoint)
-		endpoint.handler = k.newProxyHandler(u, endpoint)
+		endpoint.handler = k.newServiceHandler(svcID, endpoint)
 		k.Lock()
 		defer k.Unlock()
-		k.pathHandlers[prev.Path] = handlerListRemove(k.pathHandlers[prev.Path], prev.handler)
-		k.pathHandlers[endpoint.Path] = append(k.pathHandlers[endpoint.Path], endpoint.handler)
-		if len(k.pathHandlers[prev.Path]) == 0 {
-			delete(k.pathHandlers, prev.Path)
-		}
+		// a conflict that persists after the change is not reported again.
+		conflictsWith := prev.ConflictsWith
+		k.removeRoute(prev)
+		endpoint.ConflictsWith = conflictsWith
+		k.addRoute(endpoint)
 		k.services[svcID] = endpoint
+		k.stopHealthCheck(svcID, prev)
+		k.startHealthCheck(svcID, endpoint)
 	} else if endpoint != nil {
 		k.serviceAdd(svc)
 	} else if prev != nil {
@@ -420,19 +909,7 @@ func (k *k8sServiceProxy) serviceChange(svc *v1.Service) {
 	}
 }
 
-func getEndpointPort(svc *v1.Service) int {
-	endpointPort, exists := svc.Annotations[SvcProxyAnnotationEndpoint]
-	if !exists {
-		return -1
-	}
-	v, err := strconv.ParseUint(endpointPort, 10, 32)
-	if err != nil || v > uint64(^uint16(0)) {
-		return -1
-	}
-	return int(v)
-}
-
-func (k *k8sServiceProxy) setEndpointPort(svc *v1.Service, port int) {
+func (k *k8sServiceProxy) setEndpointPorts(svc *v1.Service, port int, named []*endpointPort) {
 	svcID := svc.Namespace + "/" + svc.Name
 
 	k.Lock()
@@ -443,20 +920,22 @@ func (k *k8sServiceProxy) setEndpointPort(svc *v1.Service, port int) {
 		k.endpoints[svcID] = data
 	}
 	data.Port = port
+	data.NamedPorts = named
+	data.resolvePorts()
 }
 
 func (k *k8sServiceProxy) addEndpointPort(svc *v1.Service) {
-	port := getEndpointPort(svc)
-	if port <= 0 {
+	port, named := getEndpointPorts(svc)
+	if port < 0 {
 		return
 	}
-	k.setEndpointPort(svc, port)
+	k.setEndpointPorts(svc, port, named)
 }
 
 func (k *k8sServiceProxy) updateEndpointPort(svc *v1.Service) {
-	port := getEndpointPort(svc)
-	if port > 0 {
-		k.setEndpointPort(svc, port)
+	port, named := getEndpointPorts(svc)
+	if port >= 0 {
+		k.setEndpointPorts(svc, port, named)
 	} else {
 		k.deleteEndpointPort(svc)
 	}
@@ -469,10 +948,12 @@ func (k *k8sServiceProxy) deleteEndpointPort(svc *v1.Service) {
 	defer k.Unlock()
 	if data, exists := k.endpoints[svcID]; exists {
 		data.Port = 0
+		data.NamedPorts = nil
+		data.resolvePorts()
 	}
 }
 
-func makeEndpointSubList(addresses []v1.EndpointAddress) []*podEndpoint {
+func makeEndpointSubList(addresses []v1.EndpointAddress, ports map[string]int, ready bool) []*podEndpoint {
 	var endpoints []*podEndpoint
 	for _, e := range addresses {
 		var podName string
@@ -480,8 +961,10 @@ func makeEndpointSubList(addresses []v1.EndpointAddress) []*podEndpoint {
 			podName = e.TargetRef.Name
 		}
 		endpoints = append(endpoints, &podEndpoint{
-			IP:      e.IP,
-			PodName: podName,
+			IP:        e.IP,
+			PodName:   podName,
+			Ready:     ready,
+			portNames: ports,
 		})
 	}
 	return endpoints
@@ -490,16 +973,17 @@ func makeEndpointSubList(addresses []v1.EndpointAddress) []*podEndpoint {
 func makeEndpointList(endpoint *v1.Endpoints) []*podEndpoint {
 	var endpoints []*podEndpoint
 	for _, subset := range endpoint.Subsets {
-		endpoints = append(endpoints, makeEndpointSubList(subset.Addresses)...)
-		endpoints = append(endpoints, makeEndpointSubList(subset.NotReadyAddresses)...)
+		ports := endpointPortNames(subset.Ports)
+		endpoints = append(endpoints, makeEndpointSubList(subset.Addresses, ports, true)...)
+		endpoints = append(endpoints, makeEndpointSubList(subset.NotReadyAddresses, ports, false)...)
 	}
 	sort.Sort(podEndpointSorter(endpoints))
 	return endpoints
 }
 
-func (k *k8sServiceProxy) setEndpointList(endpointObj *v1.Endpoints, endpointList []*podEndpoint) {
-	svcID := endpointObj.Namespace + "/" + endpointObj.Name
-
+// setEndpointList replaces the list of pods of a service. Pods that remain in the list
+// keep their state, such as the number of outstanding requests.
+func (k *k8sServiceProxy) setEndpointList(svcID string, endpointList []*podEndpoint) {
 	k.Lock()
 	defer k.Unlock()
 	data, exists := k.endpoints[svcID]
@@ -507,95 +991,226 @@ func (k *k8sServiceProxy) setEndpointList(endpointObj *v1.Endpoints, endpointLis
 		data = &endpointData{}
 		k.endpoints[svcID] = data
 	}
+
+	current := make(map[string]*podEndpoint, len(data.endpoints))
+	for _, e := range data.endpoints {
+		current[e.PodName+"/"+e.IP] = e
+	}
+	for i, e := range endpointList {
+		if prev, exists := current[e.PodName+"/"+e.IP]; exists {
+			prev.Ready = e.Ready
+			if !reflect.DeepEqual(prev.portNames, e.portNames) {
+				// The balanced route handler targets the previous port.
+				prev.lbEndpoint = nil
+			}
+			prev.portNames = e.portNames
+			endpointList[i] = prev
+		}
+	}
 	data.endpoints = endpointList
+	data.resolvePorts()
 }
 
 func (k *k8sServiceProxy) endpointUpdate(endpoint *v1.Endpoints) {
 	endpointList := makeEndpointList(endpoint)
-	k.setEndpointList(endpoint, endpointList)
+	k.setEndpointList(endpoint.Namespace+"/"+endpoint.Name, endpointList)
 }
 
 func (k *k8sServiceProxy) endpointDelete(endpoint *v1.Endpoints) {
-	k.setEndpointList(endpoint, nil)
+	k.setEndpointList(endpoint.Namespace+"/"+endpoint.Name, nil)
 }
 
-func (k *k8sServiceProxy) runOnce(svcWatcher, endpointWatcher watch.Interface) bool {
-	select {
-	case ev, ok := <-svcWatcher.ResultChan():
-		if !ok {
-			return false
-		}
-		switch ev.Type {
-		case watch.Added:
-			k.serviceAdd(ev.Object.(*v1.Service))
-			k.addEndpointPort(ev.Object.(*v1.Service))
-		case watch.Deleted:
-			k.serviceDelete(ev.Object.(*v1.Service))
-			k.deleteEndpointPort(ev.Object.(*v1.Service))
-		case watch.Modified:
-			k.serviceChange(ev.Object.(*v1.Service))
-			k.updateEndpointPort(ev.Object.(*v1.Service))
-		}
-	case ev, ok := <-endpointWatcher.ResultChan():
-		if !ok {
-			return false
-		}
-		switch ev.Type {
-		case watch.Added:
-			k.endpointUpdate(ev.Object.(*v1.Endpoints))
-		case watch.Deleted:
-			k.endpointDelete(ev.Object.(*v1.Endpoints))
-		case watch.Modified:
-			k.endpointUpdate(ev.Object.(*v1.Endpoints))
-		}
+// deletedObject unwraps the final state of an object whose deletion was
+// detected by an informer relist rather than by a watch event.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
 	}
-	return true
+	return obj
 }
 
-const maxWatcherFailures = 3
+func (k *k8sServiceProxy) serviceEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			svc := obj.(*v1.Service)
+			k.svcUpdateMutex.Lock()
+			defer k.svcUpdateMutex.Unlock()
+			k.observeService(svc)
+			k.serviceAdd(svc)
+			k.addEndpointPort(svc)
+			k.checkAnnotations(svc)
+			k.publishStatus(svc.Namespace + "/" + svc.Name)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			svc := obj.(*v1.Service)
+			k.svcUpdateMutex.Lock()
+			defer k.svcUpdateMutex.Unlock()
+			k.observeService(svc)
+			k.serviceChange(svc)
+			k.updateEndpointPort(svc)
+			k.checkAnnotations(svc)
+			k.publishStatus(svc.Namespace + "/" + svc.Name)
+		},
+		DeleteFunc: func(obj interface{}) {
+			svc, ok := deletedObject(obj).(*v1.Service)
+			if !ok {
+				return
+			}
+			k.svcUpdateMutex.Lock()
+			defer k.svcUpdateMutex.Unlock()
+			k.serviceDelete(svc)
+			k.deleteEndpointPort(svc)
+			k.forgetService(svc)
+			k.publishStatus()
+		},
+	}
+}
 
-func createWatchers(clientset *kubernetes.Clientset) (watch.Interface, watch.Interface, error) {
-	svcWatcher, err := clientset.CoreV1().Services("").Watch(metav1.ListOptions{})
-	if err != nil {
-		return nil, nil, err
+func (k *k8sServiceProxy) endpointEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k.endpointUpdate(obj.(*v1.Endpoints))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			k.endpointUpdate(obj.(*v1.Endpoints))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if endpoint, ok := deletedObject(obj).(*v1.Endpoints); ok {
+				k.endpointDelete(endpoint)
+			}
+		},
 	}
-	endpointWatcher, err := clientset.CoreV1().Endpoints("").Watch(metav1.ListOptions{})
-	if err != nil {
-		return nil, nil, err
+}
+
+// watchErrorHandler is invoked when an informer's watch fails. The reflector
+// then relists and resumes watching, applying exponential backoff between attempts.
+func watchErrorHandler(kind string) cache.WatchErrorHandler {
+	return func(_ *cache.Reflector, err error) {
+		log.Printf("k8s %s watch: %v", kind, err)
 	}
-	return svcWatcher, endpointWatcher, nil
 }
 
-func (k *k8sServiceProxy) run(clientset *kubernetes.Clientset) {
-	svcWatcher, endpointWatcher, err := createWatchers(clientset)
-	if err != nil {
-		log.Fatal(err)
+// kubernetesSource is the RouteSource that learns services and endpoints from the
+// kubernetes API server.
+type kubernetesSource struct {
+	clientset kubernetes.Interface
+	opts      *KubernetesOptions
+}
+
+// startInformers creates the informers for a single namespace. Each informer
+// performs an initial List and then watches from the returned resourceVersion;
+// on watch failures the informer relists, which delivers any events missed in between.
+// The label selector applies to services only: the backends of services that are
+// not selected are tracked but never exposed.
+func (s *kubernetesSource) startInformers(namespace string, handlers *RouteHandlers, stopCh <-chan struct{}) []cache.InformerSynced {
+	clientset, opts := s.clientset, s.opts
+	svcFactory := informers.NewSharedInformerFactoryWithOptions(clientset, opts.ResyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = opts.LabelSelector
+		}))
+	endpointFactory := informers.NewSharedInformerFactoryWithOptions(clientset, opts.ResyncPeriod,
+		informers.WithNamespace(namespace))
+
+	svcInformer := svcFactory.Core().V1().Services().Informer()
+	svcInformer.AddEventHandler(handlers.Services)
+	if err := svcInformer.SetWatchErrorHandler(watchErrorHandler("services")); err != nil {
+		log.Print(err)
 	}
 
-	for {
-	LOOP:
-		ok := k.runOnce(svcWatcher, endpointWatcher)
-		if !ok {
-			log.Print("k8s watcher channel closed")
-			var err error
-			for failures := 0; failures < maxWatcherFailures; failures++ {
-				svcWatcher, endpointWatcher, err = createWatchers(clientset)
-				if err == nil {
-					goto LOOP
-				}
-				time.Sleep(5 * time.Second)
-			}
-			log.Fatal(err)
+	var endpointInformer cache.SharedIndexInformer
+	if opts.UseEndpointSlices {
+		endpointInformer = endpointFactory.Discovery().V1().EndpointSlices().Informer()
+		endpointInformer.AddEventHandler(handlers.EndpointSlices)
+		if err := endpointInformer.SetWatchErrorHandler(watchErrorHandler("endpointslices")); err != nil {
+			log.Print(err)
+		}
+	} else {
+		endpointInformer = endpointFactory.Core().V1().Endpoints().Informer()
+		endpointInformer.AddEventHandler(handlers.Endpoints)
+		if err := endpointInformer.SetWatchErrorHandler(watchErrorHandler("endpoints")); err != nil {
+			log.Print(err)
 		}
 	}
+
+	svcFactory.Start(stopCh)
+	endpointFactory.Start(stopCh)
+	return []cache.InformerSynced{svcInformer.HasSynced, endpointInformer.HasSynced}
+}
+
+// Run populates the proxy from shared informers, one set per namespace.
+func (s *kubernetesSource) Run(handlers *RouteHandlers, stopCh <-chan struct{}) {
+	namespaces := s.opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var synced []cache.InformerSynced
+	for _, namespace := range namespaces {
+		synced = append(synced, s.startInformers(namespace, handlers, stopCh)...)
+	}
+
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		log.Print("k8s informers stopped before cache sync")
+		return
+	}
+	log.Print("k8s informer caches synced")
+}
+
+// KubernetesOptions defines how the proxy discovers services from the kubernetes API.
+type KubernetesOptions struct {
+	// ResyncPeriod is the interval at which the informers replay their cache
+	// contents to the proxy. Zero disables periodic resync.
+	ResyncPeriod time.Duration
+
+	// UseEndpointSlices selects discovery.k8s.io EndpointSlices rather than
+	// core v1 Endpoints as the source of service backends.
+	UseEndpointSlices bool
+
+	// Namespaces restricts discovery to the specified namespaces. When empty
+	// services are discovered across the whole cluster.
+	Namespaces []string
+
+	// LabelSelector restricts discovery to the services that match the selector.
+	LabelSelector string
+
+	// Kubeconfig is the path of a kubeconfig file used to access the cluster.
+	// When neither Kubeconfig, Context nor the KUBECONFIG environment variable are set,
+	// the in-cluster configuration is used, if available.
+	Kubeconfig string
+
+	// Context selects a context in the kubeconfig other than the current one.
+	Context string
+
+	// WriteStatus enables the k8s-svc-proxy.local/status annotation, which the proxy
+	// writes on each service to describe its routes.
+	WriteStatus bool
+}
+
+func newK8sServiceProxy(defaultHandler http.Handler) *k8sServiceProxy {
+	return &k8sServiceProxy{
+		pathHandlers:       make(map[string][]*svcEndpoint),
+		hostHandlers:       make(map[string]map[string][]*svcEndpoint),
+		services:           make(map[string]*svcEndpoint),
+		invalidAnnotations: make(map[string]string),
+		statusChanged:      make(map[string]bool),
+		endpoints:          make(map[string]*endpointData),
+		endpointSlices:     make(map[string]map[string][]*podEndpoint),
+		defaultHandler:     defaultHandler,
+		makeServiceURL:     makeServiceURL,
+		makeEndpointURL:    makeEndpointURL,
+	}
 }
 
 // NewKubernetesServiceProxy allocates an http proxy that demuxes URLs
 // based on the paths learnt from k8s service annotations.
-func NewKubernetesServiceProxy(mux http.Handler) http.Handler {
+func NewKubernetesServiceProxy(mux http.Handler, opts *KubernetesOptions) http.Handler {
 
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
+	if _, err := labels.Parse(opts.LabelSelector); err != nil {
+		log.Fatal(err)
+	}
+
+	config, inCluster, err := restConfig(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -605,15 +1220,25 @@ func NewKubernetesServiceProxy(mux http.Handler) http.Handler {
 		log.Fatal(err)
 	}
 
-	k8s := &k8sServiceProxy{
-		pathHandlers:   make(map[string][]http.Handler),
-		services:       make(map[string]*svcEndpoint),
-		endpoints:      make(map[string]*endpointData),
-		defaultHandler: mux,
-		makeServiceURL: makeServiceURL,
+	k8s := newK8sServiceProxy(mux)
+	if !inCluster {
+		// service DNS names and pod IPs are not reachable from outside the cluster.
+		apiServer, err := newAPIServerProxy(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("Running outside the cluster; proxying through ", apiServer.base.String())
+		k8s.makeServiceURL = apiServer.serviceURL
+		k8s.makeEndpointURL = apiServer.endpointURL
+		k8s.transport = apiServer.transport
+		k8s.wrapTransport = apiServer.wrapTransport
 	}
-
-	go k8s.run(clientset)
+	k8s.recorder = newEventRecorder(clientset)
+	if opts.WriteStatus {
+		k8s.status = newStatusWriter(clientset)
+		go k8s.status.run(wait.NeverStop)
+	}
+	go k8s.run(&kubernetesSource{clientset: clientset, opts: opts}, wait.NeverStop)
 
 	return k8s
 }
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -12,16 +14,44 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
+func dispatchEvent(handler cache.ResourceEventHandler, ev watch.Event) {
+	switch ev.Type {
+	case watch.Added:
+		handler.OnAdd(ev.Object)
+	case watch.Modified:
+		handler.OnUpdate(nil, ev.Object)
+	case watch.Deleted:
+		handler.OnDelete(ev.Object)
+	}
+}
+
+// runTest feeds the events of fake watchers to the informer event handlers.
 func runTest(k8s *k8sServiceProxy, svcWatcher, endpointWatcher watch.Interface, wg *sync.WaitGroup) {
+	svcHandler := k8s.serviceEventHandler()
+	endpointHandler := k8s.endpointEventHandler()
+LOOP:
 	for {
-		if !k8s.runOnce(svcWatcher, endpointWatcher) {
-			break
+		select {
+		case ev, ok := <-svcWatcher.ResultChan():
+			if !ok {
+				break LOOP
+			}
+			dispatchEvent(svcHandler, ev)
+		case ev, ok := <-endpointWatcher.ResultChan():
+			if !ok {
+				break LOOP
+			}
+			dispatchEvent(endpointHandler, ev)
 		}
 	}
 	wg.Done()
@@ -41,14 +71,93 @@ func makeTestURL(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
 	return u
 }
 
-func newTestProxy(wg *sync.WaitGroup) (*k8sServiceProxy, *watch.FakeWatcher, *watch.FakeWatcher) {
-	k8s := &k8sServiceProxy{
-		pathHandlers:   make(map[string][]http.Handler),
-		services:       make(map[string]*svcEndpoint),
-		endpoints:      make(map[string]*endpointData),
-		defaultHandler: http.NotFoundHandler(),
-		makeServiceURL: makeTestURL,
+// testServerPort returns the port of a test server.
+func testServerPort(server *httptest.Server) string {
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return port
+}
+
+// testPods runs an HTTP server for each pod of the service default/foo and directs the
+// requests of the proxy for a pod to its server. The pods have the addresses 10.0.0.1,
+// 10.0.0.2, ... in the order in which they are listed.
+type testPods struct {
+	names   []string
+	servers map[string]*httptest.Server
+	mutex   sync.Mutex
+	// ports holds the last port requested for each pod.
+	ports map[string]int
+}
+
+// newTestPods starts the server of each pod with the handler returned by handler; pods
+// for which it returns nil have no server and are not reachable. The servers are closed
+// at the end of the test.
+func newTestPods(t *testing.T, k8s *k8sServiceProxy, handler func(pod string) http.Handler, names ...string) *testPods {
+	p := &testPods{
+		names:   names,
+		servers: make(map[string]*httptest.Server),
+		ports:   make(map[string]int),
+	}
+	for _, name := range names {
+		if h := handler(name); h != nil {
+			server := httptest.NewServer(h)
+			t.Cleanup(server.Close)
+			p.servers[name] = server
+		}
+	}
+	k8s.makeEndpointURL = func(namespace string, endpoint *podEndpoint, port int) *url.URL {
+		p.mutex.Lock()
+		p.ports[endpoint.PodName] = port
+		p.mutex.Unlock()
+		server, exists := p.servers[endpoint.PodName]
+		if !exists {
+			return nil
+		}
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+	return p
+}
+
+func (p *testPods) address(name string) string {
+	for i, n := range p.names {
+		if n == name {
+			return fmt.Sprintf("10.0.0.%d", i+1)
+		}
+	}
+	panic("unknown pod " + name)
+}
+
+// endpoints returns the Endpoints of the service with the specified ready pods and the
+// pods listed in notReady.
+func (p *testPods) endpoints(ready []string, notReady ...string) *v1.Endpoints {
+	makeAddresses := func(names []string) []v1.EndpointAddress {
+		var addresses []v1.EndpointAddress
+		for _, name := range names {
+			addresses = append(addresses, v1.EndpointAddress{
+				IP:        p.address(name),
+				TargetRef: &v1.ObjectReference{Kind: "Pod", Name: name},
+			})
+		}
+		return addresses
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"},
+		Subsets: []v1.EndpointSubset{
+			{Addresses: makeAddresses(ready), NotReadyAddresses: makeAddresses(notReady)},
+		},
 	}
+}
+
+// port returns the last port requested for a pod.
+func (p *testPods) port(name string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.ports[name]
+}
+
+func newTestProxy(wg *sync.WaitGroup) (*k8sServiceProxy, *watch.FakeWatcher, *watch.FakeWatcher) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
 
 	svcWatcher := watch.NewFake()
 	endpointWatcher := watch.NewFake()
@@ -596,11 +705,13 @@ func TestEndpointProxy(t *testing.T) {
 		t.Fatal(len(k8s.endpoints))
 	}
 
-	expected := []string{"/debug/varz", "/"}
+	expected := []string{"/debug/varz", "/", "/debug/pprof", "/healthz"}
 
 	requestPaths := []string{
 		"http://localhost/endpoint/default/foo/0/debug/varz",
 		"http://localhost/endpoint/default/foo/0/",
+		"http://localhost/endpoint/default/foo/foo-xyz/debug/pprof",
+		"http://localhost/pod/default/foo-xyz/healthz",
 	}
 	for _, p := range requestPaths {
 		w := httptest.NewRecorder()
@@ -619,6 +730,10 @@ func TestEndpointProxy(t *testing.T) {
 		"http://localhost/endpoint/default/bar/0/debug/varz",
 		"http://localhost/endpoint/default/foo/1",
 		"http://localhost/endpoint/default/foo",
+		"http://localhost/endpoint/default/foo/foo-abc/",
+		"http://localhost/pod/default/foo-abc/",
+		"http://localhost/pod/other/foo-xyz/",
+		"http://localhost/pod/default/foo-xyz",
 	}
 	for _, p := range badRequests {
 		w := httptest.NewRecorder()
@@ -789,3 +904,237 @@ func TestMappedRedirectRelativeErr(t *testing.T) {
 		t.Error(resp.StatusCode)
 	}
 }
+
+// waitForCondition polls the proxy state, under the lock, until cond is satisfied.
+func waitForCondition(t *testing.T, k8s *k8sServiceProxy, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		k8s.Lock()
+		done := cond()
+		k8s.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for condition")
+}
+
+func TestInformerListWatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "foo",
+				Annotations: map[string]string{
+					SvcProxyAnnotationPath:     "/foo/",
+					SvcProxyAnnotationEndpoint: "8080",
+				},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"},
+			Subsets: []v1.EndpointSubset{
+				{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}},
+			},
+		})
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go k8s.run(&kubernetesSource{clientset: clientset, opts: &KubernetesOptions{ResyncPeriod: time.Minute}}, stopCh)
+
+	// Objects present before the informers start are delivered by the initial List.
+	waitForCondition(t, k8s, func() bool {
+		data, exists := k8s.endpoints["default/foo"]
+		return len(k8s.services) == 1 && exists && data.Port == 8080 && len(data.endpoints) == 1
+	})
+
+	_, err := clientset.CoreV1().Services("default").Create(context.TODO(),
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "bar",
+				Annotations: map[string]string{SvcProxyAnnotationPath: "/bar/"},
+			},
+		}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCondition(t, k8s, func() bool {
+		_, exists := k8s.pathHandlers["/bar/"]
+		return exists
+	})
+
+	err = clientset.CoreV1().Services("default").Delete(context.TODO(), "foo", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCondition(t, k8s, func() bool {
+		_, exists := k8s.services["default/foo"]
+		return !exists && k8s.endpoints["default/foo"].Port == 0
+	})
+}
+
+func TestInformerScope(t *testing.T) {
+	makeService := func(namespace, name string, labels map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        name,
+				Labels:      labels,
+				Annotations: map[string]string{SvcProxyAnnotationPath: "/" + namespace + "/" + name + "/"},
+			},
+		}
+	}
+	internal := map[string]string{"proxy-instance": "internal"}
+	external := map[string]string{"proxy-instance": "external"}
+
+	clientset := fake.NewSimpleClientset(
+		makeService("a", "foo", internal),
+		makeService("a", "bar", external),
+		makeService("a", "baz", nil),
+		makeService("b", "foo", internal),
+		makeService("c", "foo", internal),
+	)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	opts := &KubernetesOptions{
+		Namespaces:    []string{"a", "b"},
+		LabelSelector: "proxy-instance=internal",
+	}
+	go k8s.run(&kubernetesSource{clientset: clientset, opts: opts}, stopCh)
+
+	waitForCondition(t, k8s, func() bool {
+		return len(k8s.services) >= 2
+	})
+
+	// Allow for any unexpected events to be delivered.
+	time.Sleep(100 * time.Millisecond)
+	k8s.Lock()
+	var actual []string
+	for svcID := range k8s.services {
+		actual = append(actual, svcID)
+	}
+	k8s.Unlock()
+	sort.Strings(actual)
+
+	expected := []string{"a/foo", "b/foo"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Error(actual)
+	}
+}
+
+func TestFindEndpoint(t *testing.T) {
+	list := []*podEndpoint{
+		{PodName: "foo-abc", IP: "10.0.0.1"},
+		{PodName: "foo-xyz", IP: "10.0.0.2"},
+	}
+	testCases := []struct {
+		id       string
+		expected string
+	}{
+		{"foo-abc", "10.0.0.1"},
+		{"foo-xyz", "10.0.0.2"},
+		{"1", "10.0.0.2"},
+		{"2", ""},
+		{"foo-def", ""},
+	}
+	for _, tc := range testCases {
+		endpoint := findEndpoint(list, tc.id)
+		if tc.expected == "" {
+			if endpoint != nil {
+				t.Errorf("%s: expected no endpoint, got %s", tc.id, endpoint.IP)
+			}
+			continue
+		}
+		if endpoint == nil || endpoint.IP != tc.expected {
+			t.Errorf("%s: expected %s, got %v", tc.id, tc.expected, endpoint)
+		}
+	}
+}
+
+func TestGetServicePort(t *testing.T) {
+	testCases := []struct {
+		annotation string
+		ports      []v1.ServicePort
+		expected   int32
+		hasError   bool
+	}{
+		{"", []v1.ServicePort{{Port: 80}}, 80, false},
+		{"", []v1.ServicePort{{Port: 3000}}, 3000, false},
+		{"", nil, -1, false},
+		{"", []v1.ServicePort{{Name: "web", Port: 80}, {Name: "admin", Port: 9000}}, -1, true},
+		{"9000", []v1.ServicePort{{Name: "web", Port: 80}, {Name: "admin", Port: 9000}}, 9000, false},
+		{"admin", []v1.ServicePort{{Name: "web", Port: 80}, {Name: "admin", Port: 9000}}, 9000, false},
+		{"http", []v1.ServicePort{{Name: "web", Port: 80, TargetPort: intstr.FromString("http")}, {Name: "admin", Port: 9000}}, 80, false},
+		{"debug", []v1.ServicePort{{Name: "web", Port: 80}, {Name: "admin", Port: 9000}}, -1, true},
+	}
+	for i, tc := range testCases {
+		svc := &v1.Service{Spec: v1.ServiceSpec{Ports: tc.ports}}
+		if tc.annotation != "" {
+			svc.Annotations = map[string]string{SvcProxyAnnotationPort: tc.annotation}
+		}
+		port, reason := getServicePort(svc)
+		if port != tc.expected || (reason != "") != tc.hasError {
+			t.Errorf("%d: expected %d, got %d %q", i, tc.expected, port, reason)
+		}
+	}
+}
+
+func TestReservedPaths(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}))
+	defer server.Close()
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = func(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+	makeService := func(name string, annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		}
+	}
+
+	// Routes of the default host cannot be served under the endpoint pages.
+	pod := makeService("pod", map[string]string{SvcProxyAnnotationPath: "/pod/x/"})
+	if endpoint := makeSvcEndpoint(pod); endpoint != nil {
+		t.Errorf("%+v", endpoint)
+	}
+	problems := validateAnnotations(pod)
+	if len(problems) != 1 || !strings.Contains(problems[0], "/pod/ is served by the proxy") {
+		t.Error(problems)
+	}
+
+	// Host routes take precedence over the endpoint pages.
+	app := makeService("app", map[string]string{SvcProxyAnnotationHost: "app.example.com", SvcProxyAnnotationPath: "/pod/"})
+	if problems := validateAnnotations(app); len(problems) != 0 {
+		t.Error(problems)
+	}
+	k8s.serviceAdd(app)
+	testCases := []struct {
+		url      string
+		status   int
+		expected string
+	}{
+		{"http://app.example.com/pod/default/foo-xyz/", http.StatusOK, "app"},
+		{"http://localhost/pod/default/foo-xyz/", http.StatusNotFound, "No endpoint for pod default/foo-xyz\n"},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		k8s.ServeHTTP(rec, httptest.NewRequest("GET", tc.url, nil))
+		if rec.Code != tc.status || rec.Body.String() != tc.expected {
+			t.Errorf("%s: got %d %q", tc.url, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// matchCondition requires a header or query parameter to be present and, when Value is
+// not empty, to have that value.
+type matchCondition struct {
+	Name  string
+	Value string `json:",omitempty"`
+}
+
+func (c matchCondition) String() string {
+	if c.Value == "" {
+		return c.Name
+	}
+	return c.Name + "=" + c.Value
+}
+
+// routeMatch holds the conditions that a request must satisfy, in addition to the path
+// prefix, in order to be served by a route.
+type routeMatch struct {
+	Methods []string         `json:",omitempty"`
+	Headers []matchCondition `json:",omitempty"`
+	Query   []matchCondition `json:",omitempty"`
+}
+
+// parseMatchConditions parses a comma separated list of name=value conditions.
+func parseMatchConditions(value string, canonical func(string) string) ([]matchCondition, error) {
+	var conditions []matchCondition
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pieces := strings.SplitN(item, "=", 2)
+		name := strings.TrimSpace(pieces[0])
+		if name == "" {
+			return nil, fmt.Errorf("missing name in %q", item)
+		}
+		c := matchCondition{Name: canonical(name)}
+		if len(pieces) > 1 {
+			c.Value = strings.TrimSpace(pieces[1])
+		}
+		conditions = append(conditions, c)
+	}
+	sort.Slice(conditions, func(i, j int) bool { return conditions[i].String() < conditions[j].String() })
+	return conditions, nil
+}
+
+// parseMatchMethods parses a comma separated list of HTTP methods.
+func parseMatchMethods(value string) ([]string, error) {
+	var methods []string
+	for _, m := range strings.Split(value, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+		if strings.ContainsAny(m, " \t=/") {
+			return nil, fmt.Errorf("invalid method %q", m)
+		}
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
+
+func identity(s string) string { return s }
+
+// makeRouteMatch returns the match conditions of a service, or nil when the route
+// matches any request. It returns false when a condition is invalid: ignoring it would
+// let the route serve requests that it is not meant to.
+func makeRouteMatch(svc *v1.Service) (*routeMatch, bool) {
+	m := &routeMatch{}
+	var err error
+	if value, isSet := svc.Annotations[SvcProxyAnnotationMatchMethods]; isSet {
+		if m.Methods, err = parseMatchMethods(value); err != nil {
+			log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationMatchMethods, value, svc.Namespace, svc.Name, err)
+			return nil, false
+		}
+	}
+	if value, isSet := svc.Annotations[SvcProxyAnnotationMatchHeaders]; isSet {
+		if m.Headers, err = parseMatchConditions(value, http.CanonicalHeaderKey); err != nil {
+			log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationMatchHeaders, value, svc.Namespace, svc.Name, err)
+			return nil, false
+		}
+	}
+	if value, isSet := svc.Annotations[SvcProxyAnnotationMatchQuery]; isSet {
+		if m.Query, err = parseMatchConditions(value, identity); err != nil {
+			log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationMatchQuery, value, svc.Namespace, svc.Name, err)
+			return nil, false
+		}
+	}
+	if m.specificity() == 0 {
+		return nil, true
+	}
+	return m, true
+}
+
+// specificity counts the conditions of a match; routes with more conditions are
+// evaluated first.
+func (m *routeMatch) specificity() int {
+	if m == nil {
+		return 0
+	}
+	n := len(m.Headers) + len(m.Query)
+	if len(m.Methods) > 0 {
+		n++
+	}
+	return n
+}
+
+// String returns a canonical description of the conditions; routes with the same
+// description conflict with each other.
+func (m *routeMatch) String() string {
+	if m == nil {
+		return ""
+	}
+	var parts []string
+	if len(m.Methods) > 0 {
+		parts = append(parts, strings.Join(m.Methods, ","))
+	}
+	for _, c := range m.Headers {
+		parts = append(parts, "header "+c.String())
+	}
+	for _, c := range m.Query {
+		parts = append(parts, "query "+c.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches evaluates the conditions against a request.
+func (m *routeMatch) matches(req *http.Request) bool {
+	if m == nil {
+		return true
+	}
+	if len(m.Methods) > 0 && !containsValue(m.Methods, req.Method) {
+		return false
+	}
+	for _, c := range m.Headers {
+		values := req.Header.Values(c.Name)
+		if len(values) == 0 || c.Value != "" && !containsValue(values, c.Value) {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := req.URL.Query()
+		for _, c := range m.Query {
+			values, exists := query[c.Name]
+			if !exists || c.Value != "" && !containsValue(values, c.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// routeChoice is a handler that serves the requests accepted by its match conditions.
+type routeChoice struct {
+	match   *routeMatch
+	handler http.Handler
+}
+
+// routeMatcher selects between the services that serve the same route with different
+// match conditions. Routes are evaluated from the most to the least specific.
+type routeMatcher struct {
+	routes []routeChoice
+}
+
+// newRouteMatcher returns the handler of a route table entry: the handler of the
+// service that serves it or, when services have match conditions, a routeMatcher.
+// Services with the same match conditions that are not conflicted split the traffic.
+func newRouteMatcher(list []*svcEndpoint) http.Handler {
+	var keys []string
+	groups := make(map[string][]*svcEndpoint)
+	for _, e := range list {
+		if e.Conflicted {
+			continue
+		}
+		key := e.Match.String()
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+	var routes []routeChoice
+	for _, key := range keys {
+		group := groups[key]
+		routes = append(routes, routeChoice{match: group[0].Match, handler: newSplitHandler(group)})
+	}
+	if len(routes) == 1 && routes[0].match == nil {
+		return routes[0].handler
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].match.specificity() > routes[j].match.specificity()
+	})
+	return &routeMatcher{routes: routes}
+}
+
+// match returns the handler of the first route whose conditions match the request.
+func (m *routeMatcher) match(req *http.Request) http.Handler {
+	for _, r := range m.routes {
+		if r.match.matches(req) {
+			return r.handler
+		}
+	}
+	return nil
+}
+
+func (m *routeMatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h := m.match(req); h != nil {
+		h.ServeHTTP(w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
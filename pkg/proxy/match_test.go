@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMakeRouteMatch(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				SvcProxyAnnotationMatchMethods: "post, put",
+				SvcProxyAnnotationMatchHeaders: "x-debug-target=canary, X-Trace",
+				SvcProxyAnnotationMatchQuery:   "debug=1",
+			},
+		},
+	}
+	expected := &routeMatch{
+		Methods: []string{"POST", "PUT"},
+		Headers: []matchCondition{{Name: "X-Debug-Target", Value: "canary"}, {Name: "X-Trace"}},
+		Query:   []matchCondition{{Name: "debug", Value: "1"}},
+	}
+	m, valid := makeRouteMatch(svc)
+	if !valid || !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, m)
+	}
+	if m.specificity() != 4 {
+		t.Error(m.specificity())
+	}
+	if s := m.String(); s != "POST,PUT header X-Debug-Target=canary header X-Trace query debug=1" {
+		t.Error(s)
+	}
+	if m, valid := makeRouteMatch(&v1.Service{}); m != nil || !valid {
+		t.Error(m)
+	}
+
+	// A service with an invalid condition is not proxied, rather than serving every request.
+	svc.Annotations[SvcProxyAnnotationPath] = "/canary/"
+	svc.Annotations[SvcProxyAnnotationMatchHeaders] = "=canary"
+	if m, valid := makeRouteMatch(svc); m != nil || valid {
+		t.Error(m)
+	}
+	if endpoint := makeSvcEndpoint(svc); endpoint != nil {
+		t.Errorf("%+v", endpoint)
+	}
+	if _, err := parseMatchConditions("=x", identity); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRouteMatchConditions(t *testing.T) {
+	m := &routeMatch{
+		Methods: []string{"GET", "HEAD"},
+		Headers: []matchCondition{{Name: "X-Debug-Target", Value: "canary"}},
+		Query:   []matchCondition{{Name: "trace"}},
+	}
+	testCases := []struct {
+		method, url string
+		header      string
+		expected    bool
+	}{
+		{"GET", "http://localhost/foo?trace", "canary", true},
+		{"HEAD", "http://localhost/foo?trace=1", "canary", true},
+		{"POST", "http://localhost/foo?trace", "canary", false},
+		{"GET", "http://localhost/foo", "canary", false},
+		{"GET", "http://localhost/foo?trace", "stable", false},
+		{"GET", "http://localhost/foo?trace", "", false},
+	}
+	for _, test := range testCases {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		if test.header != "" {
+			req.Header.Set("X-Debug-Target", test.header)
+		}
+		if actual := m.matches(req); actual != test.expected {
+			t.Errorf("%s %s %s: expected %v", test.method, test.url, test.header, test.expected)
+		}
+	}
+}
+
+func TestMatchRouting(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	makeService := func(name, path string, annotations map[string]string) {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        name,
+				Annotations: map[string]string{SvcProxyAnnotationPath: path},
+			},
+		}
+		for k, v := range annotations {
+			svc.Annotations[k] = v
+		}
+		k8s.serviceAdd(svc)
+		k8s.services["default/"+name].handler = namedHandler(name)
+	}
+	makeService("root", "/", nil)
+	makeService("primary", "/db/", nil)
+	makeService("replica", "/db/", map[string]string{SvcProxyAnnotationMatchMethods: "GET,HEAD"})
+	makeService("canary", "/db/", map[string]string{
+		SvcProxyAnnotationMatchMethods: "GET",
+		SvcProxyAnnotationMatchHeaders: "X-Debug-Target=canary",
+	})
+	makeService("uploads", "/upload/", map[string]string{SvcProxyAnnotationMatchMethods: "POST"})
+	for _, id := range []string{"default/primary", "default/replica", "default/canary"} {
+		if e := k8s.services[id]; e.Conflicted {
+			t.Error(id, e.ConflictsWith)
+		}
+	}
+	// The handlers are replaced after the routes are installed.
+	k8s.Lock()
+	for _, e := range k8s.services {
+		k8s.updateSnapshot(e.Host, e.Path, k8s.routeTable(e.Host, false))
+	}
+	k8s.Unlock()
+
+	testCases := []struct {
+		method, path, header, expected string
+	}{
+		{"GET", "/db/x", "", "replica"},
+		{"POST", "/db/x", "", "primary"},
+		{"GET", "/db/x", "canary", "canary"},
+		{"HEAD", "/db/x", "canary", "replica"},
+		{"POST", "/upload/x", "", "uploads"},
+		{"GET", "/upload/x", "", "root"},
+	}
+	for _, test := range testCases {
+		req, _ := http.NewRequest(test.method, "http://localhost"+test.path, nil)
+		if test.header != "" {
+			req.Header.Set("X-Debug-Target", test.header)
+		}
+		rec := httptest.NewRecorder()
+		k8s.ServeHTTP(rec, req)
+		if rec.Body.String() != test.expected {
+			t.Errorf("%s %s %s: expected %s, got %s", test.method, test.path, test.header, test.expected, rec.Body.String())
+		}
+	}
+
+	// Services with the same conditions conflict.
+	makeService("replica2", "/db/", map[string]string{SvcProxyAnnotationMatchMethods: "HEAD,GET"})
+	if e := k8s.services["default/replica2"]; !e.Conflicted || e.ConflictsWith != "default/replica" {
+		t.Error(e)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultMirrorMaxBody = 64 * 1024
+	// mirrorTimeout bounds the time spent on a mirrored request.
+	mirrorTimeout = 30 * time.Second
+	// maxMirrorRequests limits the number of outstanding mirrored requests of a
+	// service; requests beyond the limit are not mirrored.
+	maxMirrorRequests = 100
+)
+
+// mirrorConfig describes the service that receives a copy of the requests of a route.
+type mirrorConfig struct {
+	Namespace string
+	Name      string
+	Port      int32
+	// Percent is the percentage of the requests that are mirrored.
+	Percent int
+	// MaxBody is the largest request body that is buffered for mirroring.
+	MaxBody int64
+}
+
+// parseMirrorService parses a [namespace/]name[:port] service reference.
+func parseMirrorService(value, namespace string) (*mirrorConfig, error) {
+	config := &mirrorConfig{Namespace: namespace, Name: value, Port: -1}
+	if i := strings.LastIndex(config.Name, ":"); i >= 0 {
+		port, err := strconv.ParseUint(config.Name[i+1:], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port in %q", value)
+		}
+		config.Port = int32(port)
+		config.Name = config.Name[:i]
+	}
+	if i := strings.Index(config.Name, "/"); i >= 0 {
+		config.Namespace, config.Name = config.Name[:i], config.Name[i+1:]
+	}
+	if config.Namespace == "" && namespace != "" || config.Name == "" || strings.Contains(config.Name, "/") {
+		return nil, fmt.Errorf("expected [namespace/]name[:port], got %q", value)
+	}
+	return config, nil
+}
+
+func makeMirrorConfig(svc *v1.Service) *mirrorConfig {
+	value, isSet := svc.Annotations[SvcProxyAnnotationMirror]
+	if !isSet {
+		return nil
+	}
+	config, err := parseMirrorService(value, svc.Namespace)
+	if err != nil {
+		log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationMirror, value, svc.Namespace, svc.Name, err)
+		return nil
+	}
+	config.Percent = 100
+	if _, exists := svc.Annotations[SvcProxyAnnotationMirrorPercent]; exists {
+		config.Percent = parseIntAnnotation(svc, SvcProxyAnnotationMirrorPercent)
+	}
+	if config.Percent > 100 {
+		config.Percent = 100
+	}
+	config.MaxBody = defaultMirrorMaxBody
+	if _, exists := svc.Annotations[SvcProxyAnnotationMirrorMaxBody]; exists {
+		config.MaxBody = int64(parseIntAnnotation(svc, SvcProxyAnnotationMirrorMaxBody))
+	}
+	return config
+}
+
+func (c *mirrorConfig) String() string {
+	return c.Namespace + "/" + c.Name
+}
+
+// mirrorHandler sends a copy of a sample of the requests of a route to another service.
+// Mirrored requests are sent asynchronously and their responses are discarded.
+type mirrorHandler struct {
+	svcID    string
+	config   *mirrorConfig
+	endpoint *svcEndpoint
+	target   *url.URL
+	client   *http.Client
+	// pending limits the number of outstanding mirrored requests.
+	pending chan struct{}
+	next    http.Handler
+}
+
+func (k *k8sServiceProxy) newMirrorHandler(svcID string, endpoint *svcEndpoint, next http.Handler) http.Handler {
+	config := endpoint.mirrorConfig
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: config.Namespace, Name: config.Name}}
+	target := k.makeServiceURL(svc, &svcEndpoint{Port: config.Port})
+	if target == nil {
+		return next
+	}
+	return &mirrorHandler{
+		svcID:    svcID,
+		config:   config,
+		endpoint: endpoint,
+		target:   target,
+		client: &http.Client{
+			Transport: k.newTransport(svcID, nil),
+			Timeout:   mirrorTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		pending: make(chan struct{}, maxMirrorRequests),
+		next:    next,
+	}
+}
+
+// mirrorURL returns the URL of a mirrored request, which follows the same path mapping as
+// the route.
+func (h *mirrorHandler) mirrorURL(req *http.Request) *url.URL {
+	u := *req.URL
+	u.Scheme = h.target.Scheme
+	u.Host = h.target.Host
+	mapPath(h.endpoint, h.target, &u)
+	return &u
+}
+
+// bufferBody reads the request body when it fits the configured limit and replaces it
+// with a copy. It returns false when the body is too large to be mirrored.
+func (h *mirrorHandler) bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > h.config.MaxBody {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, h.config.MaxBody+1))
+	original := req.Body
+	if err != nil || int64(len(body)) > h.config.MaxBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), original), original}
+		return nil, false
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), original}
+	return body, true
+}
+
+func (h *mirrorHandler) mirror(req *http.Request, body []byte) {
+	select {
+	case h.pending <- struct{}{}:
+	default:
+		return
+	}
+	mreq, err := http.NewRequestWithContext(context.Background(), req.Method, h.mirrorURL(req).String(), bytes.NewReader(body))
+	if err != nil {
+		<-h.pending
+		log.Printf("Unable to mirror request of %s: %v", h.svcID, err)
+		return
+	}
+	mreq.Header = req.Header.Clone()
+	mreq.Header.Set("X-Forwarded-Host", req.Host)
+	go func() {
+		defer func() { <-h.pending }()
+		resp, err := h.client.Do(mreq)
+		if err != nil {
+			log.Printf("Mirrored request of %s to %s failed: %v", h.svcID, h.config, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+func (h *mirrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.config.Percent > 0 && rand.Intn(100) < h.config.Percent {
+		if body, ok := h.bufferBody(req); ok {
+			h.mirror(req, body)
+		}
+	}
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseMirrorService(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected *mirrorConfig
+	}{
+		{"api-v2", &mirrorConfig{Namespace: "default", Name: "api-v2", Port: -1}},
+		{"staging/api-v2", &mirrorConfig{Namespace: "staging", Name: "api-v2", Port: -1}},
+		{"staging/api-v2:8080", &mirrorConfig{Namespace: "staging", Name: "api-v2", Port: 8080}},
+		{"staging/api-v2:http", nil},
+		{"/api-v2", nil},
+		{"a/b/c", nil},
+	}
+	for _, test := range testCases {
+		config, err := parseMirrorService(test.value, "default")
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil || *config != *test.expected {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.value, test.expected, config, err)
+		}
+	}
+}
+
+type mirroredRequest struct {
+	path, body string
+}
+
+func TestMirror(t *testing.T) {
+	var primaryBodies []string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		primaryBodies = append(primaryBodies, string(body))
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	mirrored := make(chan mirroredRequest, 10)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.URL.Path, string(body)}
+		w.Write([]byte("mirror"))
+	}))
+	defer mirror.Close()
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = func(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+		if svc.Name == "api-v2" {
+			u, _ := url.Parse(mirror.URL)
+			return u
+		}
+		u, _ := url.Parse(primary.URL)
+		return u
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "api",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:          "/api/",
+				SvcProxyAnnotationMap:           "/v1/",
+				SvcProxyAnnotationMirror:        "api-v2",
+				SvcProxyAnnotationMirrorMaxBody: "16",
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+	if e := k8s.services["default/api"]; e.Mirror != "default/api-v2" {
+		t.Fatal(e.Mirror)
+	}
+
+	serve := func(req *http.Request) string {
+		rec := httptest.NewRecorder()
+		k8s.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	post := func(body string) string {
+		return serve(httptest.NewRequest("POST", "http://localhost/api/items", strings.NewReader(body)))
+	}
+	if resp := post("small"); resp != "primary" {
+		t.Error(resp)
+	}
+	select {
+	case r := <-mirrored:
+		if r.path != "/v1/items" || r.body != "small" {
+			t.Error(r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	// Bodies over the limit are sent to the primary but not mirrored.
+	large := strings.Repeat("x", 100)
+	if resp := post(large); resp != "primary" {
+		t.Error(resp)
+	}
+	if primaryBodies[1] != large {
+		t.Error(primaryBodies[1])
+	}
+	// The length of a chunked body is only known once it is read.
+	req := httptest.NewRequest("POST", "http://localhost/api/items", strings.NewReader(large))
+	req.ContentLength = -1
+	if resp := serve(req); resp != "primary" {
+		t.Error(resp)
+	}
+	if primaryBodies[2] != large {
+		t.Error(primaryBodies[2])
+	}
+	select {
+	case r := <-mirrored:
+		t.Error("unexpected mirrored request", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	svc.Annotations[SvcProxyAnnotationMirrorPercent] = "0"
+	k8s.serviceChange(svc)
+	post("small")
+	select {
+	case r := <-mirrored:
+		t.Error("unexpected mirrored request", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// radixNode is a node of an immutable radix tree that maps path prefixes to
+// handlers. Updates copy the nodes along the modified path and return a new root,
+// so a tree can be read concurrently without locking.
+type radixNode struct {
+	prefix  string
+	handler http.Handler
+	// children are sorted by the first byte of their prefix.
+	children []*radixNode
+}
+
+func (n *radixNode) clone() *radixNode {
+	c := *n
+	c.children = append([]*radixNode(nil), n.children...)
+	return &c
+}
+
+// child returns the index of the child whose prefix starts with b, or the index
+// at which such a child would be inserted.
+func (n *radixNode) child(b byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= b })
+	return i, i < len(n.children) && n.children[i].prefix[0] == b
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// insert returns a tree in which key maps to handler.
+func (n *radixNode) insert(key string, handler http.Handler) *radixNode {
+	if n == nil {
+		return &radixNode{prefix: key, handler: handler}
+	}
+	common := commonPrefixLen(n.prefix, key)
+	if common < len(n.prefix) {
+		split := n.clone()
+		split.prefix = n.prefix[common:]
+		parent := &radixNode{prefix: n.prefix[:common], children: []*radixNode{split}}
+		if common == len(key) {
+			parent.handler = handler
+		} else {
+			leaf := &radixNode{prefix: key[common:], handler: handler}
+			if leaf.prefix[0] < split.prefix[0] {
+				parent.children = []*radixNode{leaf, split}
+			} else {
+				parent.children = append(parent.children, leaf)
+			}
+		}
+		return parent
+	}
+
+	c := n.clone()
+	key = key[common:]
+	if key == "" {
+		c.handler = handler
+		return c
+	}
+	i, found := c.child(key[0])
+	if found {
+		c.children[i] = c.children[i].insert(key, handler)
+	} else {
+		c.children = append(c.children, nil)
+		copy(c.children[i+1:], c.children[i:])
+		c.children[i] = &radixNode{prefix: key, handler: handler}
+	}
+	return c
+}
+
+// remove returns a tree without key; nodes left without a handler are merged with
+// their only child.
+func (n *radixNode) remove(key string) *radixNode {
+	if n == nil || !strings.HasPrefix(key, n.prefix) {
+		return n
+	}
+	key = key[len(n.prefix):]
+	var c *radixNode
+	if key == "" {
+		if n.handler == nil {
+			return n
+		}
+		c = n.clone()
+		c.handler = nil
+	} else {
+		i, found := n.child(key[0])
+		if !found {
+			return n
+		}
+		child := n.children[i].remove(key)
+		if child == n.children[i] {
+			return n
+		}
+		c = n.clone()
+		if child == nil {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+		} else {
+			c.children[i] = child
+		}
+	}
+
+	if c.handler == nil {
+		switch len(c.children) {
+		case 0:
+			return nil
+		case 1:
+			merged := c.children[0].clone()
+			merged.prefix = c.prefix + merged.prefix
+			return merged
+		}
+	}
+	return c
+}
+
+// prefixHandlers appends the handlers of the keys that are a prefix of path, from the
+// shortest to the longest.
+func (n *radixNode) prefixHandlers(path string, handlers []http.Handler) []http.Handler {
+	for n != nil && strings.HasPrefix(path, n.prefix) {
+		path = path[len(n.prefix):]
+		if n.handler != nil {
+			handlers = append(handlers, n.handler)
+		}
+		if path == "" {
+			break
+		}
+		i, found := n.child(path[0])
+		if !found {
+			break
+		}
+		n = n.children[i]
+	}
+	return handlers
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func linearLongestPrefix(routes map[string]http.Handler, path string) http.Handler {
+	var bestMatch string
+	var handler http.Handler
+	for k, v := range routes {
+		if strings.HasPrefix(path, k) && len(k) >= len(bestMatch) {
+			bestMatch = k
+			handler = v
+		}
+	}
+	return handler
+}
+
+func TestRadixTree(t *testing.T) {
+	var root *radixNode
+	for _, key := range []string{"/foo/", "/foobar/", "/f", "/bar/", "/"} {
+		root = root.insert(key, namedHandler(key))
+	}
+	testCases := []struct {
+		path, expected string
+	}{
+		{"/foo/x", "/foo/"},
+		{"/foobar/x", "/foobar/"},
+		{"/foob", "/f"},
+		{"/bar", "/"},
+		{"/bar/", "/bar/"},
+		{"", ""},
+	}
+	for _, test := range testCases {
+		h := longestPrefix(root, test.path)
+		if test.expected == "" && h != nil || test.expected != "" && (h == nil || string(h.(namedHandler)) != test.expected) {
+			t.Errorf("%q: expected %q, got %v", test.path, test.expected, h)
+		}
+	}
+
+	// Updates leave previous versions of the tree unchanged.
+	prev := root
+	root = root.remove("/foo/")
+	if h := longestPrefix(prev, "/foo/x"); h == nil || string(h.(namedHandler)) != "/foo/" {
+		t.Error(h)
+	}
+	if h := longestPrefix(root, "/foo/x"); h == nil || string(h.(namedHandler)) != "/f" {
+		t.Error(h)
+	}
+
+	for _, key := range []string{"/foobar/", "/f", "/bar/", "/", "/missing"} {
+		root = root.remove(key)
+	}
+	if root != nil {
+		t.Errorf("expected empty tree, got %+v", root)
+	}
+}
+
+// longestPrefix returns the handler of the longest key that is a prefix of path.
+func longestPrefix(n *radixNode, path string) http.Handler {
+	if handlers := n.prefixHandlers(path, nil); len(handlers) > 0 {
+		return handlers[len(handlers)-1]
+	}
+	return nil
+}
+
+func TestRadixTreeRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	segments := []string{"a", "ab", "abc", "b", "x/", "/"}
+	randomPath := func() string {
+		var sb strings.Builder
+		sb.WriteString("/")
+		for n := rnd.Intn(5); n > 0; n-- {
+			sb.WriteString(segments[rnd.Intn(len(segments))])
+		}
+		return sb.String()
+	}
+
+	routes := make(map[string]http.Handler)
+	var root *radixNode
+	for i := 0; i < 2000; i++ {
+		key := randomPath()
+		if _, exists := routes[key]; exists && rnd.Intn(2) == 0 {
+			delete(routes, key)
+			root = root.remove(key)
+		} else {
+			routes[key] = namedHandler(key)
+			root = root.insert(key, routes[key])
+		}
+
+		path := randomPath()
+		expected := linearLongestPrefix(routes, path)
+		if actual := longestPrefix(root, path); actual != expected {
+			t.Fatalf("%s: expected %v, got %v", path, expected, actual)
+		}
+	}
+}
+
+func benchmarkRoutes(n int) (*k8sServiceProxy, []*http.Request) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	var requests []*http.Request
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/ns-%d/svc-%d/", i%97, i)
+		k8s.addRoute(&svcEndpoint{Path: path, handler: namedHandler(path)})
+		requests = append(requests, &http.Request{URL: &url.URL{Path: path + "api/v1/items"}})
+	}
+	return k8s, requests
+}
+
+func BenchmarkMatchRoute(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		k8s, requests := benchmarkRoutes(n)
+		b.Run(fmt.Sprintf("routes-%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if k8s.matchRoute(requests[i%len(requests)]) == nil {
+						b.Fatal("no match")
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// rewriteRule replaces a request path that matches a regular expression with a template
+// that may refer to the capture groups of the expression and include a query string.
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	// inverse and inverseTemplate translate backend paths back into the path space of the
+	// proxy; inverse is nil when the rule cannot be inverted.
+	inverse         *regexp.Regexp
+	inverseTemplate string
+}
+
+// queryEdit sets a query parameter or, when remove is true, deletes it.
+type queryEdit struct {
+	name, value string
+	remove      bool
+}
+
+// rewriteConfig holds the rewrite rules of a route, evaluated in order, and the edits
+// applied to the query string of every request.
+type rewriteConfig struct {
+	rules []*rewriteRule
+	query []queryEdit
+}
+
+func parseRewriteRules(value string) ([]*rewriteRule, error) {
+	var rules []*rewriteRule
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected a pattern and a replacement in %q", line)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rule := &rewriteRule{pattern: pattern, replacement: fields[1]}
+		rule.inverse, rule.inverseTemplate = invertRewrite(fields[0], fields[1])
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseQueryEdits(value string) ([]queryEdit, error) {
+	var edits []queryEdit
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "-") {
+			edits = append(edits, queryEdit{name: item[1:], remove: true})
+			continue
+		}
+		pieces := strings.SplitN(item, "=", 2)
+		if len(pieces) != 2 || pieces[0] == "" {
+			return nil, fmt.Errorf("expected name=value or -name, got %q", item)
+		}
+		edits = append(edits, queryEdit{name: pieces[0], value: pieces[1]})
+	}
+	return edits, nil
+}
+
+func makeRewriteConfig(svc *v1.Service) *rewriteConfig {
+	config := &rewriteConfig{}
+	var err error
+	if value, isSet := svc.Annotations[SvcProxyAnnotationRewrite]; isSet {
+		if config.rules, err = parseRewriteRules(value); err != nil {
+			log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationRewrite, value, svc.Namespace, svc.Name, err)
+		}
+	}
+	if value, isSet := svc.Annotations[SvcProxyAnnotationRewriteQuery]; isSet {
+		if config.query, err = parseQueryEdits(value); err != nil {
+			log.Printf("Invalid annotation %s (%s) for %s/%s: %v", SvcProxyAnnotationRewriteQuery, value, svc.Namespace, svc.Name, err)
+		}
+	}
+	if len(config.rules) == 0 && len(config.query) == 0 {
+		return nil
+	}
+	return config
+}
+
+// String describes the rules and query edits for the status page.
+func (c *rewriteConfig) String() string {
+	var parts []string
+	for _, rule := range c.rules {
+		parts = append(parts, rule.pattern.String()+" "+rule.replacement)
+	}
+	for _, edit := range c.query {
+		if edit.remove {
+			parts = append(parts, "query -"+edit.name)
+		} else {
+			parts = append(parts, "query "+edit.name+"="+edit.value)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// apply rewrites the path and query of a request URL. It returns false when no rule
+// matches the path, in which case the path is left unchanged.
+func (c *rewriteConfig) apply(basePath string, u *url.URL) bool {
+	matched := false
+	for _, rule := range c.rules {
+		path := u.Path
+		match := rule.pattern.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		// The query of the replacement is split off before expansion, so that a captured
+		// "?", "&" or "=" from the decoded path cannot add query parameters.
+		template := rule.replacement
+		var query string
+		if i := strings.Index(template, "?"); i >= 0 {
+			template, query = template[:i], template[i+1:]
+		}
+		u.Path = basePath + string(rule.pattern.ExpandString(nil, template, path, match))
+		u.RawPath = ""
+		if query != "" {
+			values := u.Query()
+			extra, err := url.ParseQuery(query)
+			if err != nil {
+				log.Printf("Invalid query in rewrite of %s: %v", u.Path, err)
+			}
+			for name, v := range extra {
+				name = string(rule.pattern.ExpandString(nil, name, path, match))
+				values.Del(name)
+				for _, s := range v {
+					values.Add(name, string(rule.pattern.ExpandString(nil, s, path, match)))
+				}
+			}
+			u.RawQuery = values.Encode()
+		}
+		matched = true
+		break
+	}
+	if len(c.query) > 0 {
+		values := u.Query()
+		for _, edit := range c.query {
+			if edit.remove {
+				values.Del(edit.name)
+			} else {
+				values.Set(edit.name, edit.value)
+			}
+		}
+		u.RawQuery = values.Encode()
+	}
+	return matched
+}
+
+// invert translates a backend path into the path space of the proxy using the first
+// invertible rule that matches it.
+func (c *rewriteConfig) invert(path string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for _, rule := range c.rules {
+		if rule.inverse == nil {
+			continue
+		}
+		if match := rule.inverse.FindStringSubmatchIndex(path); match != nil {
+			return string(rule.inverse.ExpandString(nil, rule.inverseTemplate, path, match)), true
+		}
+	}
+	return "", false
+}
+
+// invertRewrite derives the inverse of a rule whose pattern is anchored at the start of
+// the path and consists of literal text and capture groups, and whose replacement path
+// refers to each group exactly once. The groups of the inverse expression are named so
+// that groups nested in the original ones do not change their numbering.
+func invertRewrite(pattern, replacement string) (*regexp.Regexp, string) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, ""
+	}
+	parts := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		parts = re.Sub
+	}
+	if len(parts) == 0 || parts[0].Op != syntax.OpBeginText {
+		return nil, ""
+	}
+	parts = parts[1:]
+	if n := len(parts); n > 0 && parts[n-1].Op == syntax.OpEndText {
+		parts = parts[:n-1]
+	}
+
+	var template strings.Builder
+	groups := make(map[int]string)
+	for _, part := range parts {
+		switch {
+		case part.Op == syntax.OpLiteral && part.Flags&syntax.FoldCase == 0:
+			template.WriteString(strings.ReplaceAll(string(part.Rune), "$", "$$"))
+		case part.Op == syntax.OpCapture:
+			groups[part.Cap] = part.Sub[0].String()
+			fmt.Fprintf(&template, "${g%d}", part.Cap)
+		default:
+			return nil, ""
+		}
+	}
+
+	if i := strings.Index(replacement, "?"); i >= 0 {
+		replacement = replacement[:i]
+	}
+	var inverse strings.Builder
+	inverse.WriteString("^")
+	used := make(map[int]bool)
+	for len(replacement) > 0 {
+		i := strings.Index(replacement, "$")
+		if i < 0 {
+			inverse.WriteString(regexp.QuoteMeta(replacement))
+			break
+		}
+		inverse.WriteString(regexp.QuoteMeta(replacement[:i]))
+		replacement = replacement[i+1:]
+		if strings.HasPrefix(replacement, "$") {
+			inverse.WriteString(regexp.QuoteMeta("$"))
+			replacement = replacement[1:]
+			continue
+		}
+		var name string
+		if strings.HasPrefix(replacement, "{") {
+			end := strings.Index(replacement, "}")
+			if end < 0 {
+				return nil, ""
+			}
+			name, replacement = replacement[1:end], replacement[end+1:]
+		} else {
+			end := 0
+			for end < len(replacement) && isNameByte(replacement[end]) {
+				end++
+			}
+			name, replacement = replacement[:end], replacement[end:]
+		}
+		n, err := strconv.Atoi(name)
+		sub, exists := groups[n]
+		if err != nil || !exists || used[n] {
+			return nil, ""
+		}
+		used[n] = true
+		fmt.Fprintf(&inverse, "(?P<g%d>%s)", n, sub)
+	}
+	if len(used) != len(groups) {
+		return nil, ""
+	}
+	inverse.WriteString("$")
+	compiled, err := regexp.Compile(inverse.String())
+	if err != nil {
+		return nil, ""
+	}
+	return compiled, template.String()
+}
+
+// isNameByte reports whether b may be part of a $name reference in a replacement.
+func isNameByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
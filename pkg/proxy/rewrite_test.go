@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRewriteApply(t *testing.T) {
+	rules, err := parseRewriteRules(`^/svc/(v[0-9]+)/(.*) /api/$1/$2
+^/legacy/(.*) /new/${1}?compat=1
+^/search/([^/]*) /find?q=$1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := parseQueryEdits("-debug, client=proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &rewriteConfig{rules: rules, query: query}
+
+	testCases := []struct {
+		url, expected string
+		matched       bool
+	}{
+		{"/svc/v2/items/1?debug=1&x=y", "/base/api/v2/items/1?client=proxy&x=y", true},
+		{"/legacy/page", "/base/new/page?client=proxy&compat=1", true},
+		{"/other/page", "/other/page?client=proxy", false},
+		// An encoded "?" in a captured group stays in the path.
+		{"/legacy/a%3Fdebug=1", "/base/new/a%3Fdebug=1?client=proxy&compat=1", true},
+		{"/search/a%26debug=1", "/base/find?client=proxy&q=a%26debug%3D1", true},
+	}
+	for _, test := range testCases {
+		u, _ := url.Parse(test.url)
+		matched := config.apply("/base", u)
+		if matched != test.matched || u.String() != test.expected {
+			t.Errorf("%s: expected %s (%v), got %s (%v)", test.url, test.expected, test.matched, u.String(), matched)
+		}
+	}
+}
+
+func TestRewriteInvert(t *testing.T) {
+	testCases := []struct {
+		pattern, replacement string
+		path, expected       string
+	}{
+		{`^/svc/(v[0-9]+)/(.*)`, "/api/$1/$2", "/api/v1/login", "/svc/v1/login"},
+		{`^/svc/(v[0-9]+)/(.*)$`, "/$2/${1}", "/login/v3", "/svc/v3/login"},
+		{`^/docs/((a|b)+)/(.*)`, "/x/$1/$3?lang=en", "/x/abba/index.html", "/docs/abba/index.html"},
+		// Rules that are not anchored, refer to a group twice or omit a group are not inverted.
+		{`/svc/(.*)`, "/api/$1", "/api/login", ""},
+		{`^/svc/(.*)`, "/api/$1/$1", "/api/a/a", ""},
+		{`^/svc/(v[0-9]+)/(.*)`, "/api/$2", "/api/login", ""},
+		{`^/svc/[a-z]+/(.*)`, "/api/$1", "/api/login", ""},
+	}
+	for _, test := range testCases {
+		rules, err := parseRewriteRules(test.pattern + " " + test.replacement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &rewriteConfig{rules: rules}
+		actual, ok := config.invert(test.path)
+		if test.expected == "" && ok || test.expected != "" && actual != test.expected {
+			t.Errorf("%s %s: expected %q, got %q (%v)", test.pattern, test.replacement, test.expected, actual, ok)
+		}
+	}
+}
+
+func TestRewriteProxy(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/api/v1/old":
+			http.Redirect(w, r, "/api/v1/new", http.StatusFound)
+			return
+		case "/api/v1/private":
+			http.Redirect(w, r, "https://accounts.example.com/api/v1/login?next=1", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = func(svc *v1.Service, endpoint *svcEndpoint) *url.URL {
+		u, _ := url.Parse(server.URL)
+		return u
+	}
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "api",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:         "/svc/",
+				SvcProxyAnnotationRewrite:      `^/svc/(v[0-9]+)/(.*) /api/$1/$2`,
+				SvcProxyAnnotationRewriteQuery: "-token",
+			},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost/svc/v1/items?token=x&page=2", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || len(requests) != 1 || requests[0] != "/api/v1/items?page=2" {
+		t.Error(rec.Code, requests)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://localhost/svc/v1/old", nil)
+	k8s.ServeHTTP(rec, req)
+	if location := rec.Header().Get("Location"); location != "/svc/v1/new" {
+		t.Error(rec.Code, location)
+	}
+
+	// Redirects to other hosts are not translated.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://localhost/svc/v1/private", nil)
+	k8s.ServeHTTP(rec, req)
+	if location := rec.Header().Get("Location"); rec.Code != http.StatusFound ||
+		location != "https://accounts.example.com/api/v1/login?next=1" {
+		t.Error(rec.Code, location)
+	}
+}
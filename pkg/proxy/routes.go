@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// routeSnapshot is an immutable view of the route tables used to match requests
+// without holding the lock.
+type routeSnapshot struct {
+	paths *radixNode
+	hosts map[string]*radixNode
+}
+
+func (k *k8sServiceProxy) snapshot() *routeSnapshot {
+	if s, ok := k.routes.Load().(*routeSnapshot); ok {
+		return s
+	}
+	return &routeSnapshot{}
+}
+
+// updateSnapshot publishes the handler of a path after its route table changes.
+// Must be called with the lock held.
+func (k *k8sServiceProxy) updateSnapshot(host, path string, table map[string][]*svcEndpoint) {
+	prev := k.snapshot()
+	next := &routeSnapshot{paths: prev.paths, hosts: prev.hosts}
+	root := prev.paths
+	if host != "" {
+		root = prev.hosts[host]
+	}
+	if list := table[path]; len(list) > 0 {
+		root = root.insert(path, newRouteMatcher(list))
+	} else {
+		root = root.remove(path)
+	}
+
+	if host == "" {
+		next.paths = root
+	} else {
+		next.hosts = make(map[string]*radixNode, len(prev.hosts)+1)
+		for h, r := range prev.hosts {
+			next.hosts[h] = r
+		}
+		if root != nil {
+			next.hosts[host] = root
+		} else {
+			delete(next.hosts, host)
+		}
+	}
+	k.routes.Store(next)
+}
+
+// routeTable returns the routes of a host; routes without a host are kept in
+// pathHandlers. Must be called with the lock held.
+func (k *k8sServiceProxy) routeTable(host string, create bool) map[string][]*svcEndpoint {
+	if host == "" {
+		return k.pathHandlers
+	}
+	table, exists := k.hostHandlers[host]
+	if !exists && create {
+		table = make(map[string][]*svcEndpoint)
+		k.hostHandlers[host] = table
+	}
+	return table
+}
+
+// routeLess orders the services that claim the same route: higher priority first,
+// then the oldest service, with the service name as the tie breaker.
+func routeLess(a, b *svcEndpoint) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.created.Equal(b.created) {
+		return a.created.Before(b.created)
+	}
+	return a.id < b.id
+}
+
+// resolveConflicts marks the services that lose a route to a service earlier in the
+// list with the same match conditions. Weighted services do not conflict when the
+// first service is weighted: they split the traffic of the route. Must be called
+// with the lock held.
+func (k *k8sServiceProxy) resolveConflicts(list []*svcEndpoint) {
+	winners := make(map[string]*svcEndpoint)
+	for _, e := range list {
+		key := e.Match.String()
+		winner, exists := winners[key]
+		if !exists {
+			winners[key] = e
+			if e.Conflicted {
+				k.statusChanged[e.id] = true
+			}
+			e.Conflicted = false
+			e.ConflictsWith = ""
+			continue
+		}
+		if winner.weighted && e.weighted {
+			if e.Conflicted {
+				k.statusChanged[e.id] = true
+			}
+			e.Conflicted = false
+			e.ConflictsWith = ""
+			continue
+		}
+		if e.ConflictsWith != winner.id {
+			log.Printf("Route %s%s of %s conflicts with %s", e.Host, e.Path, e.id, winner.id)
+			k.recordEvent(e.ref, v1.EventTypeWarning, eventReasonPathConflict,
+				"Route %s%s is served by service %s", e.Host, e.Path, winner.id)
+			k.statusChanged[e.id] = true
+		}
+		e.Conflicted = true
+		e.ConflictsWith = winner.id
+	}
+	k.updateTraffic(list)
+}
+
+// addRoute installs the handler of a service endpoint. Must be called with the lock held.
+func (k *k8sServiceProxy) addRoute(endpoint *svcEndpoint) {
+	table := k.routeTable(endpoint.Host, true)
+	list := append(table[endpoint.Path], endpoint)
+	sort.SliceStable(list, func(i, j int) bool { return routeLess(list[i], list[j]) })
+	table[endpoint.Path] = list
+	k.resolveConflicts(list)
+	k.updateSnapshot(endpoint.Host, endpoint.Path, table)
+}
+
+// removeRoute uninstalls the handler of a service endpoint. Must be called with the lock held.
+func (k *k8sServiceProxy) removeRoute(endpoint *svcEndpoint) {
+	table := k.routeTable(endpoint.Host, false)
+	if table == nil {
+		return
+	}
+	var list []*svcEndpoint
+	for _, e := range table[endpoint.Path] {
+		if e != endpoint {
+			list = append(list, e)
+		}
+	}
+	if len(list) == 0 {
+		delete(table, endpoint.Path)
+	} else {
+		table[endpoint.Path] = list
+	}
+	endpoint.Conflicted = false
+	endpoint.ConflictsWith = ""
+	endpoint.Traffic = ""
+	k.resolveConflicts(list)
+	k.updateSnapshot(endpoint.Host, endpoint.Path, table)
+	if endpoint.Host != "" && len(table) == 0 {
+		delete(k.hostHandlers, endpoint.Host)
+	}
+}
+
+// matchRoute selects the handler of a request. Routes of the exact host are preferred
+// over wildcard hosts, from the most to the least specific, followed by the endpoint
+// pages of the proxy and the routes that do not specify a host. Within a host, the
+// longest path prefix whose match conditions accept the request is selected. It reads
+// the current snapshot and does not require the lock.
+func (k *k8sServiceProxy) matchRoute(req *http.Request) http.Handler {
+	routes := k.snapshot()
+	if h := routes.matchHost(req); h != nil {
+		return h
+	}
+	if h := k.endpointPage(req.URL.Path); h != nil {
+		return h
+	}
+	return routes.matchPath(req)
+}
+
+// matchHost selects the handler of a request among the routes that specify a host.
+func (s *routeSnapshot) matchHost(req *http.Request) http.Handler {
+	host, path := requestHost(req), req.URL.Path
+	if host == "" || len(s.hosts) == 0 {
+		return nil
+	}
+	var buf [8]http.Handler
+	if h := selectHandler(s.hosts[host].prefixHandlers(path, buf[:0]), req); h != nil {
+		return h
+	}
+	for i := strings.Index(host, "."); i >= 0; {
+		suffix := host[i:]
+		if h := selectHandler(s.hosts["*"+suffix].prefixHandlers(path, buf[:0]), req); h != nil {
+			return h
+		}
+		next := strings.Index(suffix[1:], ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil
+}
+
+// matchPath selects the handler of a request among the routes that do not specify a host.
+func (s *routeSnapshot) matchPath(req *http.Request) http.Handler {
+	var buf [8]http.Handler
+	return selectHandler(s.paths.prefixHandlers(req.URL.Path, buf[:0]), req)
+}
+
+// selectHandler returns the handler of the longest prefix that accepts the request.
+func selectHandler(handlers []http.Handler, req *http.Request) http.Handler {
+	for i := len(handlers) - 1; i >= 0; i-- {
+		m, ok := handlers[i].(*routeMatcher)
+		if !ok {
+			return handlers[i]
+		}
+		if h := m.match(req); h != nil {
+			return h
+		}
+	}
+	return nil
+}
+
+// requestHost returns the host name of a request without the port.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
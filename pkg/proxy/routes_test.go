@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(h))
+}
+
+func TestMatchRoute(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	routes := []struct {
+		host, path string
+	}{
+		{"", "/"},
+		{"", "/foo/"},
+		{"grafana.debug.example.com", "/"},
+		{"grafana.debug.example.com", "/api/"},
+		{"*.debug.example.com", "/"},
+		{"*.example.com", "/static/"},
+	}
+	endpoints := make(map[string]*svcEndpoint)
+	for _, r := range routes {
+		endpoint := &svcEndpoint{Host: r.host, Path: r.path, handler: namedHandler(r.host + r.path)}
+		endpoints[r.host+r.path] = endpoint
+		k8s.addRoute(endpoint)
+	}
+
+	testCases := []struct {
+		host, path, expected string
+	}{
+		{"grafana.debug.example.com", "/api/x", "grafana.debug.example.com/api/"},
+		{"grafana.debug.example.com", "/x", "grafana.debug.example.com/"},
+		{"prometheus.debug.example.com", "/x", "*.debug.example.com/"},
+		{"a.b.debug.example.com", "/x", "*.debug.example.com/"},
+		{"www.example.com", "/static/x", "*.example.com/static/"},
+		{"www.example.com", "/foo/x", "/foo/"},
+		{"example.com", "/static/x", "/"},
+		{"", "/foo/x", "/foo/"},
+	}
+	for _, test := range testCases {
+		req := &http.Request{Host: test.host, URL: &url.URL{Path: test.path}}
+		h := k8s.matchRoute(req)
+		if h == nil || string(h.(namedHandler)) != test.expected {
+			t.Errorf("%s%s: expected %s, got %v", test.host, test.path, test.expected, h)
+		}
+	}
+
+	k8s.removeRoute(endpoints["*.debug.example.com/"])
+	if _, exists := k8s.hostHandlers["*.debug.example.com"]; exists {
+		t.Error("empty host table not removed")
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	testCases := map[string]string{
+		"Grafana.Example.com":    "grafana.example.com",
+		"grafana.example.com:80": "grafana.example.com",
+		"grafana.example.com.":   "grafana.example.com",
+		"[::1]:8080":             "::1",
+	}
+	for host, expected := range testCases {
+		req := &http.Request{Host: host}
+		if actual := requestHost(req); actual != expected {
+			t.Errorf("%s: expected %s, got %s", host, expected, actual)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "monitoring",
+			Name:      "grafana",
+			Annotations: map[string]string{
+				SvcProxyAnnotationHost: "${NAME}.debug.example.com",
+			},
+		},
+	}
+	k8s.serviceAdd(svc)
+
+	endpoint := k8s.services["monitoring/grafana"]
+	if endpoint == nil || endpoint.Host != "grafana.debug.example.com" || endpoint.Path != "/" {
+		t.Fatal(endpoint)
+	}
+	if _, exists := k8s.hostHandlers["grafana.debug.example.com"]["/"]; !exists {
+		t.Error(k8s.hostHandlers)
+	}
+	if len(k8s.pathHandlers) != 0 {
+		t.Error(k8s.pathHandlers)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/x", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Error(rec.Code)
+	}
+
+	k8s.serviceDelete(svc)
+	if len(k8s.hostHandlers) != 0 {
+		t.Error(k8s.hostHandlers)
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	recorder := record.NewFakeRecorder(10)
+	k8s.recorder = recorder
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	makeService := func(name string, age time.Duration, annotations map[string]string) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(base.Add(-age)),
+				Annotations:       map[string]string{SvcProxyAnnotationPath: "/foo/"},
+			},
+		}
+		for k, v := range annotations {
+			svc.Annotations[k] = v
+		}
+		return svc
+	}
+	winner := func() string {
+		h := k8s.matchRoute(&http.Request{URL: &url.URL{Path: "/foo/"}})
+		for id, endpoint := range k8s.services {
+			if endpoint.handler == h {
+				return id
+			}
+		}
+		return ""
+	}
+	expectEvent := func(expected string) {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, expected) {
+				t.Error(event)
+			}
+		default:
+			t.Errorf("expected event %s", expected)
+		}
+	}
+
+	older := makeService("older", time.Hour, nil)
+	newer := makeService("newer", time.Minute, nil)
+	k8s.serviceAdd(newer)
+	k8s.serviceAdd(older)
+	if w := winner(); w != "default/older" {
+		t.Error(w)
+	}
+	if e := k8s.services["default/newer"]; !e.Conflicted || e.ConflictsWith != "default/older" {
+		t.Error(e)
+	}
+	expectEvent("Warning PathConflict Route /foo/ is served by service default/older")
+
+	// An explicit priority takes precedence over the creation time.
+	priority := makeService("priority", 0, map[string]string{SvcProxyAnnotationPriority: "10"})
+	k8s.serviceAdd(priority)
+	if w := winner(); w != "default/priority" {
+		t.Error(w)
+	}
+	if e := k8s.services["default/older"]; !e.Conflicted || e.ConflictsWith != "default/priority" {
+		t.Error(e)
+	}
+	expectEvent("default/priority")
+	expectEvent("default/priority")
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost"+serviceDiscoveryPage, nil)
+	k8s.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"Conflicted":true,"ConflictsWith":"default/priority"`) {
+		t.Error(rec.Body.String())
+	}
+
+	k8s.serviceDelete(priority)
+	if w := winner(); w != "default/older" {
+		t.Error(w)
+	}
+	if e := k8s.services["default/older"]; e.Conflicted {
+		t.Error(e)
+	}
+	expectEvent("default/older")
+	select {
+	case event := <-recorder.Events:
+		t.Error("unexpected event: ", event)
+	default:
+	}
+}
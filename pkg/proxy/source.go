@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RouteHandlers receive the route configuration delivered by a RouteSource.
+// Services carries *v1.Service objects whose annotations define the routes;
+// Endpoints and EndpointSlices carry the backends of those services.
+type RouteHandlers struct {
+	Services       cache.ResourceEventHandler
+	Endpoints      cache.ResourceEventHandler
+	EndpointSlices cache.ResourceEventHandler
+}
+
+// RouteSource discovers the services exposed by the proxy.
+type RouteSource interface {
+	// Run delivers route updates to the handlers until stopCh is closed.
+	Run(handlers *RouteHandlers, stopCh <-chan struct{})
+}
+
+func (k *k8sServiceProxy) routeHandlers() *RouteHandlers {
+	return &RouteHandlers{
+		Services:       k.serviceEventHandler(),
+		Endpoints:      k.endpointEventHandler(),
+		EndpointSlices: k.endpointSliceEventHandler(),
+	}
+}
+
+func (k *k8sServiceProxy) run(source RouteSource, stopCh <-chan struct{}) {
+	source.Run(k.routeHandlers(), stopCh)
+}
+
+// NewServiceProxy allocates an http proxy that demuxes URLs based on the
+// routes learnt from the specified source.
+func NewServiceProxy(mux http.Handler, source RouteSource) http.Handler {
+	k8s := newK8sServiceProxy(mux)
+	go k8s.run(source, wait.NeverStop)
+	return k8s
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// makeWeight returns the weight annotation of a service; weighted services that claim the
+// same route split its traffic rather than conflict.
+func makeWeight(svc *v1.Service) (int32, bool) {
+	value, isSet := svc.Annotations[SvcProxyAnnotationWeight]
+	if !isSet {
+		return 0, false
+	}
+	w, err := strconv.ParseUint(value, 10, 31)
+	if err != nil {
+		log.Printf("Invalid annotation %s (%s) for %s/%s", SvcProxyAnnotationWeight, value, svc.Namespace, svc.Name)
+		return 0, false
+	}
+	return int32(w), true
+}
+
+// splitHandler forwards each request to one of the services of a route, chosen at random
+// in proportion to their weights.
+type splitHandler struct {
+	handlers []http.Handler
+	weights  []int64
+	// total is the sum of the weights, which may exceed the range of a weight.
+	total int64
+}
+
+// newSplitHandler returns the handler of the services that serve a route with the same
+// match conditions. The first service serves all requests unless the route is split.
+func newSplitHandler(group []*svcEndpoint) http.Handler {
+	s := &splitHandler{}
+	for _, e := range group {
+		if !e.weighted || e.Weight == 0 {
+			continue
+		}
+		s.handlers = append(s.handlers, e.handler)
+		s.weights = append(s.weights, int64(e.Weight))
+		s.total += int64(e.Weight)
+	}
+	switch len(s.handlers) {
+	case 0:
+		return group[0].handler
+	case 1:
+		return s.handlers[0]
+	}
+	return s
+}
+
+func (s *splitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := rand.Int63n(s.total)
+	for i, weight := range s.weights {
+		if n < weight {
+			s.handlers[i].ServeHTTP(w, r)
+			return
+		}
+		n -= weight
+	}
+}
+
+// updateTraffic computes the share of the traffic of a route received by each service.
+// Must be called with the lock held, after resolveConflicts.
+func (k *k8sServiceProxy) updateTraffic(list []*svcEndpoint) {
+	totals := make(map[string]int64)
+	split := make(map[string]bool)
+	for _, e := range list {
+		if e.Conflicted {
+			continue
+		}
+		key := e.Match.String()
+		if _, exists := totals[key]; exists {
+			split[key] = true
+		}
+		totals[key] += int64(e.Weight)
+	}
+	for _, e := range list {
+		var traffic string
+		key := e.Match.String()
+		switch {
+		case e.Conflicted || !split[key]:
+		case totals[key] == 0 && e == firstOf(list, key):
+			// newSplitHandler uses the first service when all the weights are zero.
+			traffic = "100%"
+		case totals[key] == 0:
+			traffic = "0%"
+		default:
+			traffic = fmt.Sprintf("%.3g%%", 100*float64(e.Weight)/float64(totals[key]))
+		}
+		if e.Traffic != traffic {
+			e.Traffic = traffic
+			k.statusChanged[e.id] = true
+		}
+	}
+}
+
+// firstOf returns the first service of the list with the specified match conditions.
+func firstOf(list []*svcEndpoint, key string) *svcEndpoint {
+	for _, e := range list {
+		if e.Match.String() == key {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWeightedSplit(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	makeService := func(name string, age time.Duration, weight string) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(base.Add(-age)),
+				Annotations:       map[string]string{SvcProxyAnnotationPath: "/tool/"},
+			},
+		}
+		if weight != "" {
+			svc.Annotations[SvcProxyAnnotationWeight] = weight
+		}
+		return svc
+	}
+	setHandlers := func() {
+		k8s.Lock()
+		defer k8s.Unlock()
+		for id, e := range k8s.services {
+			e.handler = namedHandler(id)
+		}
+		k8s.updateSnapshot("", "/tool/", k8s.pathHandlers)
+	}
+	serve := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/tool/x", nil)
+			k8s.ServeHTTP(rec, req)
+			counts[rec.Body.String()]++
+		}
+		return counts
+	}
+
+	stable := makeService("stable", time.Hour, "90")
+	canary := makeService("canary", time.Minute, "10")
+	other := makeService("other", 0, "")
+	k8s.serviceAdd(stable)
+	k8s.serviceAdd(canary)
+	k8s.serviceAdd(other)
+	setHandlers()
+
+	for id, expected := range map[string]string{"default/stable": "90%", "default/canary": "10%", "default/other": ""} {
+		if e := k8s.services[id]; e.Traffic != expected {
+			t.Errorf("%s: expected %q, got %q", id, expected, e.Traffic)
+		}
+	}
+	if e := k8s.services["default/other"]; !e.Conflicted || e.ConflictsWith != "default/stable" {
+		t.Error(e)
+	}
+	if e := k8s.services["default/canary"]; e.Conflicted {
+		t.Error(e)
+	}
+
+	counts := serve(2000)
+	if counts["default/other"] != 0 || counts["default/canary"] < 100 || counts["default/canary"] > 300 {
+		t.Error(counts)
+	}
+
+	// A weight of zero drains the canary.
+	k8s.serviceChange(makeService("canary", time.Minute, "0"))
+	setHandlers()
+	if e := k8s.services["default/stable"]; e.Traffic != "100%" {
+		t.Error(e.Traffic)
+	}
+	if counts := serve(100); counts["default/stable"] != 100 {
+		t.Error(counts)
+	}
+
+	// The sum of large weights exceeds the range of a weight.
+	k8s.serviceChange(makeService("stable", time.Hour, "1500000000"))
+	k8s.serviceChange(makeService("canary", time.Minute, "1500000000"))
+	setHandlers()
+	if e := k8s.services["default/canary"]; e.Traffic != "50%" {
+		t.Error(e.Traffic)
+	}
+	if counts := serve(100); counts["default/stable"]+counts["default/canary"] != 100 {
+		t.Error(counts)
+	}
+
+	// Without the weight on the first service the route is not split.
+	k8s.serviceChange(makeService("stable", time.Hour, ""))
+	if e := k8s.services["default/canary"]; !e.Conflicted || e.Traffic != "" {
+		t.Error(e)
+	}
+}
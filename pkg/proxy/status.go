@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// statusWriter publishes the status of the routes of each service in the
+// k8s-svc-proxy.local/status annotation of the service.
+type statusWriter struct {
+	clientset kubernetes.Interface
+	queue     workqueue.RateLimitingInterface
+
+	mu sync.Mutex
+	// desired is the status computed by the proxy and current the value of the
+	// annotation, as last observed or written.
+	desired map[string]string
+	current map[string]string
+}
+
+func newStatusWriter(clientset kubernetes.Interface) *statusWriter {
+	return &statusWriter{
+		clientset: clientset,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		desired:   make(map[string]string),
+		current:   make(map[string]string),
+	}
+}
+
+// observe records the status annotation of a service delivered by the informer.
+func (w *statusWriter) observe(svc *v1.Service) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current[svc.Namespace+"/"+svc.Name] = svc.Annotations[SvcProxyAnnotationStatus]
+}
+
+// set schedules a write of the status of a service when it differs from its annotation.
+func (w *statusWriter) set(svcID, status string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current, known := w.current[svcID]
+	if !known {
+		return
+	}
+	w.desired[svcID] = status
+	if status != current {
+		w.queue.Add(svcID)
+	}
+}
+
+func (w *statusWriter) forget(svcID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.desired, svcID)
+	delete(w.current, svcID)
+}
+
+func (w *statusWriter) write(svcID, status string) error {
+	pieces := strings.SplitN(svcID, "/", 2)
+	var value interface{}
+	if status != "" {
+		value = status
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{SvcProxyAnnotationStatus: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.clientset.CoreV1().Services(pieces[0]).Patch(
+		context.TODO(), pieces[1], types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (w *statusWriter) processNextItem() bool {
+	key, quit := w.queue.Get()
+	if quit {
+		return false
+	}
+	defer w.queue.Done(key)
+	svcID := key.(string)
+
+	w.mu.Lock()
+	status, exists := w.desired[svcID]
+	current := w.current[svcID]
+	w.mu.Unlock()
+	if !exists || status == current {
+		w.queue.Forget(key)
+		return true
+	}
+
+	if err := w.write(svcID, status); err != nil {
+		log.Printf("Unable to update the status of %s: %v", svcID, err)
+		w.queue.AddRateLimited(key)
+		return true
+	}
+	w.queue.Forget(key)
+	w.mu.Lock()
+	if _, known := w.current[svcID]; known {
+		w.current[svcID] = status
+	}
+	w.mu.Unlock()
+	return true
+}
+
+func (w *statusWriter) run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		w.queue.ShutDown()
+	}()
+	for w.processNextItem() {
+	}
+}
+
+// routeStatus describes the routes of a service and any problems with its annotations.
+// Must be called with the lock held.
+func (k *k8sServiceProxy) routeStatus(svcID string) string {
+	var parts []string
+	if problems := k.invalidAnnotations[svcID]; problems != "" {
+		parts = append(parts, "invalid annotations: "+problems)
+	}
+	if e, exists := k.services[svcID]; exists {
+		route := e.Host + e.Path
+		if e.Match != nil {
+			route += " [" + e.Match.String() + "]"
+		}
+		if e.PortError != "" {
+			parts = append(parts, "no port: "+e.PortError)
+		}
+		switch {
+		case e.Conflicted:
+			parts = append(parts, fmt.Sprintf("conflict: %s is served by %s", route, e.ConflictsWith))
+		case e.target != nil:
+			parts = append(parts, fmt.Sprintf("serving %s -> %s%s", route, e.target.String(), e.Map))
+			if e.Traffic != "" {
+				parts = append(parts, "traffic "+e.Traffic)
+			}
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// publishStatus updates the status annotation of the specified services along with the
+// services whose route conflicts were affected by the last change.
+func (k *k8sServiceProxy) publishStatus(svcIDs ...string) {
+	k.Lock()
+	changed := k.statusChanged
+	k.statusChanged = make(map[string]bool)
+	if k.status == nil {
+		k.Unlock()
+		return
+	}
+	for _, id := range svcIDs {
+		changed[id] = true
+	}
+	statuses := make(map[string]string, len(changed))
+	for id := range changed {
+		statuses[id] = k.routeStatus(id)
+	}
+	k.Unlock()
+
+	for id, status := range statuses {
+		k.status.set(id, status)
+	}
+}
+
+// observeService records the status annotation of a service delivered by the informer.
+func (k *k8sServiceProxy) observeService(svc *v1.Service) {
+	if k.status != nil {
+		k.status.observe(svc)
+	}
+}
+
+// forgetService discards the annotation state of a deleted service.
+func (k *k8sServiceProxy) forgetService(svc *v1.Service) {
+	svcID := svc.Namespace + "/" + svc.Name
+	k.Lock()
+	delete(k.invalidAnnotations, svcID)
+	k.Unlock()
+	if k.status != nil {
+		k.status.forget(svcID)
+	}
+}
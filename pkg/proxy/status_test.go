@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRouteStatus(t *testing.T) {
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	makeService := func(name string, annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        name,
+				Annotations: annotations,
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: 3000}},
+			},
+		}
+	}
+	first := makeService("first", map[string]string{SvcProxyAnnotationPath: "/foo/", SvcProxyAnnotationPriority: "1"})
+	second := makeService("second", map[string]string{SvcProxyAnnotationPath: "/foo/", SvcProxyAnnotationPort: "x"})
+	k8s.serviceAdd(first)
+	k8s.serviceAdd(second)
+	k8s.checkAnnotations(second)
+
+	testCases := map[string]string{
+		"default/first":  "serving /foo/ -> http://localhost:3000",
+		"default/second": `no port: "x" is not the name of a port of the service; conflict: /foo/ is served by default/first`,
+		"default/other":  "",
+	}
+	for svcID, expected := range testCases {
+		if actual := k8s.routeStatus(svcID); actual != expected {
+			t.Errorf("%s: expected %q, got %q", svcID, expected, actual)
+		}
+	}
+	if !k8s.statusChanged["default/second"] {
+		t.Error(k8s.statusChanged)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "example",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath: "/foo/",
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(svc)
+	w := newStatusWriter(clientset)
+	defer w.queue.ShutDown()
+
+	getStatus := func() (string, bool) {
+		t.Helper()
+		svc, err := clientset.CoreV1().Services("default").Get(context.TODO(), "example", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, exists := svc.Annotations[SvcProxyAnnotationStatus]
+		return status, exists
+	}
+
+	// Services that have not been observed are ignored.
+	w.set("default/other", "serving")
+	if w.queue.Len() != 0 {
+		t.Error(w.queue.Len())
+	}
+
+	w.observe(svc)
+	w.set("default/example", "serving /foo/")
+	w.processNextItem()
+	if status, _ := getStatus(); status != "serving /foo/" {
+		t.Error(status)
+	}
+
+	// Unchanged status is not written again.
+	w.set("default/example", "serving /foo/")
+	if w.queue.Len() != 0 {
+		t.Error(w.queue.Len())
+	}
+
+	w.set("default/example", "")
+	w.processNextItem()
+	if status, exists := getStatus(); exists {
+		t.Error(status)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// transportConfig is the connection configuration of a service route.
+type transportConfig struct {
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	// RequestTimeout limits the duration of a request, including the response body.
+	RequestTimeout  time.Duration
+	IdleConnTimeout time.Duration
+	MaxIdleConns    int
+	// Retries is the number of times an idempotent request is retried after a
+	// connection error or a 502, 503 or 504 response.
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+func makeTransportConfig(svc *v1.Service) *transportConfig {
+	config := &transportConfig{
+		ConnectTimeout:        parseDurationAnnotation(svc, SvcProxyAnnotationConnectTimeout, 0),
+		ResponseHeaderTimeout: parseDurationAnnotation(svc, SvcProxyAnnotationResponseHeaderTimeout, 0),
+		RequestTimeout:        parseDurationAnnotation(svc, SvcProxyAnnotationRequestTimeout, 0),
+		IdleConnTimeout:       parseDurationAnnotation(svc, SvcProxyAnnotationIdleConnTimeout, 0),
+		MaxIdleConns:          parseIntAnnotation(svc, SvcProxyAnnotationMaxIdleConns),
+		Retries:               parseIntAnnotation(svc, SvcProxyAnnotationRetries),
+	}
+	if config.Retries > 0 {
+		config.RetryBackoff = parseDurationAnnotation(svc, SvcProxyAnnotationRetryBackoff, defaultRetryBackoff)
+	}
+	if *config == (transportConfig{}) {
+		return nil
+	}
+	return config
+}
+
+// hasConnectionSettings returns true when the route requires a dedicated http.Transport.
+func (c *transportConfig) hasConnectionSettings() bool {
+	return c.ConnectTimeout > 0 || c.ResponseHeaderTimeout > 0 || c.IdleConnTimeout > 0 || c.MaxIdleConns > 0
+}
+
+// newTransport returns the transport used by a service route. Routes without connection
+// settings share the transport of the proxy.
+func (k *k8sServiceProxy) newTransport(svcID string, config *transportConfig) http.RoundTripper {
+	if config == nil {
+		return k.transport
+	}
+	transport := k.transport
+	if config.hasConnectionSettings() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if config.ConnectTimeout > 0 {
+			t.DialContext = (&net.Dialer{
+				Timeout:   config.ConnectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext
+		}
+		t.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+		if config.IdleConnTimeout > 0 {
+			t.IdleConnTimeout = config.IdleConnTimeout
+		}
+		if config.MaxIdleConns > 0 {
+			t.MaxIdleConnsPerHost = config.MaxIdleConns
+		}
+		transport = t
+		if k.wrapTransport != nil {
+			rt, err := k.wrapTransport(t)
+			if err != nil {
+				log.Printf("Unable to configure the transport of %s: %v", svcID, err)
+				return k.transport
+			}
+			transport = rt
+		}
+	}
+	if config.Retries > 0 {
+		transport = &retryTransport{next: transport, retries: config.Retries, backoff: config.RetryBackoff}
+	}
+	return transport
+}
+
+// retryTransport retries idempotent requests that fail with a connection error or a
+// gateway error status, doubling the backoff after each attempt.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if !isIdempotent(req) {
+		return next.RoundTrip(req)
+	}
+
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := next.RoundTrip(req)
+		if attempt == t.retries || err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// deadlineHandler limits the duration of the requests of a service route.
+type deadlineHandler struct {
+	timeout time.Duration
+	next    http.Handler
+}
+
+func (h *deadlineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// proxyErrorHandler reports backend timeouts as 504 rather than 502.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("http: proxy error: %v", err)
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
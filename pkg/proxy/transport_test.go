@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMakeTransportConfig(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				SvcProxyAnnotationConnectTimeout:        "1s",
+				SvcProxyAnnotationResponseHeaderTimeout: "5s",
+				SvcProxyAnnotationMaxIdleConns:          "4",
+				SvcProxyAnnotationRetries:               "2",
+			},
+		},
+	}
+	config := makeTransportConfig(svc)
+	expected := &transportConfig{
+		ConnectTimeout:        time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          4,
+		Retries:               2,
+		RetryBackoff:          defaultRetryBackoff,
+	}
+	if config == nil || *config != *expected {
+		t.Fatal(config)
+	}
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	wrapped := false
+	k8s.wrapTransport = func(t *http.Transport) (http.RoundTripper, error) {
+		wrapped = true
+		return t, nil
+	}
+	rt, ok := k8s.newTransport("default/foo", config).(*retryTransport)
+	if !ok {
+		t.Fatalf("expected retryTransport, got %T", rt)
+	}
+	transport, ok := rt.next.(*http.Transport)
+	if !ok || transport.ResponseHeaderTimeout != 5*time.Second || transport.MaxIdleConnsPerHost != 4 || !wrapped {
+		t.Error(transport)
+	}
+
+	if config := makeTransportConfig(&v1.Service{}); config != nil {
+		t.Error(config)
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryTransport{retries: 2, backoff: time.Millisecond}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&hits) != 3 {
+		t.Error(resp.StatusCode, hits)
+	}
+
+	// Requests that are not idempotent are not retried.
+	atomic.StoreInt32(&hits, 0)
+	resp, err = client.Post(server.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&hits) != 1 {
+		t.Error(resp.StatusCode, hits)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	port := testServerPort(server)
+
+	k8s := newK8sServiceProxy(http.NotFoundHandler())
+	k8s.makeServiceURL = makeTestURL
+	k8s.serviceAdd(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				SvcProxyAnnotationPath:           "/foo/",
+				SvcProxyAnnotationPort:           port,
+				SvcProxyAnnotationRequestTimeout: "50ms",
+			},
+		},
+	})
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/foo/x", nil)
+	k8s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Error(rec.Code)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("request took %v", d)
+	}
+}
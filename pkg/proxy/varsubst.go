@@ -1,34 +1,134 @@
 package proxy
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
 )
 
 var (
-	reVar = regexp.MustCompile(`\$\{([A-Za-z][A-Za-z0-9_]*)\}`)
+	reVarName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
 )
 
-// ExpandVars performs variable expansion of variables in the form of ${VAR}.
-func ExpandVars(vars map[string]string, value string) string {
-	matches := reVar.FindAllStringSubmatchIndex(value, -1)
-	if len(matches) == 0 {
-		return value
+// varScope holds the values that variable references can refer to: plain variables,
+// as ${NAME}, and the labels and annotations of a service, as ${LABEL:key} and
+// ${ANNOTATION:key}.
+type varScope struct {
+	vars        map[string]string
+	labels      map[string]string
+	annotations map[string]string
+}
+
+func serviceVars(svc *v1.Service) *varScope {
+	return &varScope{
+		vars: map[string]string{
+			"NAME":      svc.Name,
+			"NAMESPACE": svc.Namespace,
+		},
+		labels:      svc.Labels,
+		annotations: svc.Annotations,
+	}
+}
+
+// varFunctions are the functions that can be applied to the value of a variable, as in
+// ${NAME|trimPrefix:svc-}.
+var varFunctions = map[string]func(value, arg string) string{
+	"lower":      func(value, _ string) string { return strings.ToLower(value) },
+	"upper":      func(value, _ string) string { return strings.ToUpper(value) },
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+}
+
+// eval returns the value of the expression of a variable reference: a variable, an
+// optional ":-default" used when the variable is not set or empty, and a list of
+// functions separated by "|".
+func (s *varScope) eval(expr string) (string, error) {
+	pipeline := strings.Split(expr, "|")
+	ref := pipeline[0]
+	var defaultValue string
+	hasDefault := false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		ref, defaultValue, hasDefault = ref[:i], ref[i+2:], true
+	}
+
+	var value string
+	var found bool
+	switch {
+	case strings.HasPrefix(ref, "LABEL:"):
+		value, found = s.labels[ref[len("LABEL:"):]]
+	case strings.HasPrefix(ref, "ANNOTATION:"):
+		value, found = s.annotations[ref[len("ANNOTATION:"):]]
+	case reVarName.MatchString(ref):
+		value, found = s.vars[ref]
+	default:
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+	if hasDefault && value == "" {
+		value, found = defaultValue, true
+	}
+	if !found {
+		return "", fmt.Errorf("undefined variable %s", ref)
 	}
-	offset := 0
-	for _, match := range matches {
-		begin := match[0]
-		end := match[1]
+
+	for _, call := range pipeline[1:] {
+		pieces := strings.SplitN(call, ":", 2)
+		fn, exists := varFunctions[pieces[0]]
+		if !exists {
+			return "", fmt.Errorf("unknown function %s", pieces[0])
+		}
+		var arg string
+		if len(pieces) > 1 {
+			arg = pieces[1]
+		}
+		value = fn(value, arg)
+	}
+	return value, nil
+}
+
+// expand replaces the variable references of a value. In strict mode the first invalid
+// reference is an error; otherwise invalid references are left unchanged.
+func (s *varScope) expand(value string, strict bool) (string, error) {
+	var sb strings.Builder
+	for {
+		begin := strings.Index(value, "${")
+		if begin < 0 {
+			break
+		}
+		end := strings.Index(value[begin:], "}")
 		if end < 0 {
-			continue
+			if strict {
+				return "", fmt.Errorf("unterminated variable reference in %q", value)
+			}
+			break
 		}
-		begin += offset
-		end += offset
-		varName := value[match[2]+offset : match[3]+offset]
-		if repl, exists := vars[varName]; exists {
-			delta := len(repl) - (end - begin)
-			offset += delta
-			value = value[:begin] + repl + value[end:]
+		end += begin
+		sb.WriteString(value[:begin])
+		repl, err := s.eval(value[begin+2 : end])
+		if err != nil {
+			if strict {
+				return "", err
+			}
+			repl = value[begin : end+1]
 		}
+		sb.WriteString(repl)
+		value = value[end+1:]
 	}
-	return value
+	sb.WriteString(value)
+	return sb.String(), nil
+}
+
+// ExpandVars performs variable expansion of variables in the form of ${VAR}. References
+// to variables that are not defined are left unchanged.
+func ExpandVars(vars map[string]string, value string) string {
+	result, _ := (&varScope{vars: vars}).expand(value, false)
+	return result
+}
+
+// expandServiceVars performs variable expansion of an annotation value of a service. The
+// value may refer to ${NAME}, ${NAMESPACE}, ${LABEL:key} and ${ANNOTATION:key}, with an
+// optional default value, as in ${LABEL:team:-infra}, and functions, as in ${NAME|lower}.
+func expandServiceVars(svc *v1.Service, value string) (string, error) {
+	return serviceVars(svc).expand(value, true)
 }
@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"strings"
 	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestExpandVars(t *testing.T) {
@@ -28,3 +32,83 @@ func TestExpandVars(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandServiceVars(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "monitoring",
+			Name:        "svc-Grafana",
+			Labels:      map[string]string{"app.kubernetes.io/name": "grafana", "tier": ""},
+			Annotations: map[string]string{"team": "Observability"},
+		},
+	}
+	testCases := []struct {
+		value, expect string
+	}{
+		{"/${NAMESPACE}/${NAME}/", "/monitoring/svc-Grafana/"},
+		{"/${LABEL:app.kubernetes.io/name}/", "/grafana/"},
+		{"${ANNOTATION:team|lower}", "observability"},
+		{"/${NAME|trimPrefix:svc-|lower}/", "/grafana/"},
+		{"/${LABEL:tier:-backend}/${LABEL:missing:-x}/", "/backend/x/"},
+		{"${ANNOTATION:team|upper|trimSuffix:Y}", "OBSERVABILIT"},
+		{"/${NAME:-}", "/svc-Grafana"},
+	}
+	for _, test := range testCases {
+		actual, err := expandServiceVars(svc, test.value)
+		if err != nil || actual != test.expect {
+			t.Errorf("%s: expected %s, got %s (%v)", test.value, test.expect, actual, err)
+		}
+	}
+
+	for _, value := range []string{"/${SERVICE}/", "/${LABEL:missing}/", "/${NAME|reverse}/", "/${NAME", "/${a-b}/"} {
+		if actual, err := expandServiceVars(svc, value); err == nil {
+			t.Errorf("%s: expected an error, got %s", value, actual)
+		}
+	}
+}
+
+func TestServiceVarsAnnotations(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "monitoring",
+			Name:      "grafana",
+			Labels:    map[string]string{"team": "Infra"},
+			Annotations: map[string]string{
+				SvcProxyAnnotationHost:        "${NAME}.${LABEL:team|lower}.example.com",
+				SvcProxyAnnotationMap:         "/${NAMESPACE}/",
+				SvcProxyAnnotationDescription: "Dashboards of ${LABEL:team}",
+			},
+		},
+	}
+	endpoint := makeSvcEndpoint(svc)
+	if endpoint == nil || endpoint.Host != "grafana.infra.example.com" || endpoint.Map != "/monitoring/" ||
+		endpoint.Description != "Dashboards of Infra" {
+		t.Fatalf("%+v", endpoint)
+	}
+
+	// Paths served by the proxy itself are checked after expansion.
+	svc.Annotations[SvcProxyAnnotationPath] = "/${NAME|trimPrefix:grafana}k8s-svc-proxy/"
+	if endpoint := makeSvcEndpoint(svc); endpoint != nil {
+		t.Errorf("%+v", endpoint)
+	}
+
+	svc.Annotations[SvcProxyAnnotationPath] = "/${LABEL:app}/"
+	if endpoint := makeSvcEndpoint(svc); endpoint != nil {
+		t.Errorf("%+v", endpoint)
+	}
+	problems := validateAnnotations(svc)
+	if len(problems) != 1 || !strings.Contains(problems[0], "undefined variable LABEL:app") {
+		t.Error(problems)
+	}
+
+	// An invalid description is reported and shown unexpanded, but the route is kept.
+	delete(svc.Annotations, SvcProxyAnnotationPath)
+	svc.Annotations[SvcProxyAnnotationDescription] = "Dashboards of ${LABEL:owner}"
+	if endpoint := makeSvcEndpoint(svc); endpoint == nil || endpoint.Description != "Dashboards of ${LABEL:owner}" {
+		t.Errorf("%+v", endpoint)
+	}
+	problems = validateAnnotations(svc)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], SvcProxyAnnotationDescription) {
+		t.Error(problems)
+	}
+}